@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/tuananh/helm-oci-proxy/pkg/auth"
+	"github.com/tuananh/helm-oci-proxy/pkg/types"
+)
+
+// withAuth puts the authentication configured in config in front of next.
+// With the token flow, it also registers the /token endpoint, which only
+// grants what acl allows.
+func withAuth(ctx context.Context, config types.AuthConfig, acl *auth.ACL, next http.Handler) (http.Handler, error) {
+	m := &auth.Middleware{Realm: config.Realm}
+	if config.Htpasswd != "" {
+		users, err := auth.NewHtpasswd(config.Htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		m.Sources = append(m.Sources, users)
+	}
+	if len(config.Tokens) > 0 {
+		tokens := make(auth.StaticTokens, 0, len(config.Tokens))
+		for _, t := range config.Tokens {
+			if t.Subject == "" || t.Token == "" {
+				return nil, fmt.Errorf("static tokens need a subject and a token")
+			}
+			tokens = append(tokens, auth.StaticToken{Subject: t.Subject, Token: t.Token})
+		}
+		m.Sources = append(m.Sources, tokens)
+	}
+	for _, oc := range config.OIDC {
+		o, err := auth.NewOIDC(oc)
+		if err != nil {
+			return nil, err
+		}
+		m.Sources = append(m.Sources, o)
+		m.Verifiers = append(m.Verifiers, o)
+	}
+	if len(m.Sources) == 0 {
+		return nil, fmt.Errorf("auth needs htpasswd, tokens or oidc")
+	}
+
+	if tc := config.Token; tc != nil {
+		var key crypto.Signer
+		var err error
+		if tc.Key != "" {
+			key, err = auth.LoadSigningKey(tc.Key)
+		} else {
+			slog.WarnContext(ctx, "No token signing key configured, tokens will only be valid on this replica until it restarts")
+			key, err = auth.GenerateSigningKey()
+		}
+		if err != nil {
+			return nil, err
+		}
+		ts, err := auth.NewTokenService(key, m.Sources)
+		if err != nil {
+			return nil, err
+		}
+		if tc.Service != "" {
+			ts.Service = tc.Service
+		}
+		if tc.Issuer != "" {
+			ts.Issuer = tc.Issuer
+		}
+		if tc.TTL > 0 {
+			ts.TTL = tc.TTL
+		}
+		if ts.Realm, err = tokenRealm(tc.Realm); err != nil {
+			return nil, err
+		}
+		ts.ACL = acl
+		m.Tokens = ts
+		m.Verifiers = append(m.Verifiers, ts)
+		http.Handle("/token", ts)
+	}
+	return m.Wrap(next), nil
+}
+
+// tokenRealm checks the configured URL of the token endpoint. There is no
+// default, as the host clients use can't be trusted to tell it.
+func tokenRealm(realm string) (string, error) {
+	if realm == "" {
+		return "", errors.New("auth.token.realm is required, e.g. https://charts.example.com/token")
+	}
+	u, err := url.Parse(realm)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("auth.token.realm %q is not an absolute http(s) URL", realm)
+	}
+	return realm, nil
+}
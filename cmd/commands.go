@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+
+	"github.com/tuananh/helm-oci-proxy/pkg/serve"
+	"github.com/tuananh/helm-oci-proxy/pkg/types"
+)
+
+// commands are the maintenance commands, run as `helm-oci-proxy <command> [flags]`.
+var commands = map[string]func(ctx context.Context, args []string) error{
+	"gc":             runGC,
+	"index":          runIndex,
+	"migrate":        runMigrate,
+	"migrate-layout": runMigrateLayout,
+	"migrate-tags":   runMigrateTags,
+	"resync":         runResync,
+	"retention":      runRetention,
+	"verify":         runVerify,
+}
+
+func runCommand(ctx context.Context, name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for n := range commands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command %q (available: %v)", name, names)
+	}
+	return cmd(ctx, args)
+}
+
+// newFlagSet returns the flag set of a command with the common -config flag.
+func newFlagSet(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	configFile := fs.String("config", "", "Path to config file")
+	return fs, configFile
+}
+
+// commandConfig loads the config file given to a command.
+func commandConfig(configFile string) (types.Config, error) {
+	config := defaultConfig()
+	if configFile == "" {
+		return config, fmt.Errorf("-config is required")
+	}
+	if err := loadConfig(configFile, &config); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// commandStorage creates the storage for a command. The hot cache and digest
+// verification are left out so that commands always see what is in the
+// bucket, corrupt or not.
+func commandStorage(ctx context.Context, config types.StorageConfig) (serve.StorageBackend, error) {
+	config.Cache = nil
+	config.VerifyDigests = false
+	return serve.NewStorageWithConfig(ctx, config)
+}
+
+// commandServer returns a server for a command, with the default storage and
+// that of every repository that overrides it.
+func commandServer(ctx context.Context, config types.Config) (*server, error) {
+	stores, err := openStores(ctx, config, commandStorage)
+	if err != nil {
+		return nil, err
+	}
+	return &server{stores: stores, config: config}, nil
+}
+
+// copyObject copies the object name in src to the object to in dst.
+func copyObject(ctx context.Context, src serve.StorageBackend, name string, dst serve.StorageBackend, to string) error {
+	rc, desc, err := src.Open(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return dst.Put(ctx, to, desc, rc)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/tuananh/helm-oci-proxy/pkg/serve"
+)
+
+// runGC deletes blobs that no tag pointer references any more.
+func runGC(ctx context.Context, args []string) error {
+	fs, configFile := newFlagSet("gc")
+	dryRun := fs.Bool("dry-run", false, "Only log what would be deleted")
+	grace := fs.Duration("grace", 24*time.Hour, "Keep unreferenced blobs younger than this")
+	fs.Parse(args)
+
+	if least := 2 * serve.BlobTouchInterval; *grace < least {
+		return fmt.Errorf("-grace must be at least %s, so that blobs reused by running builds are kept", least)
+	}
+
+	config, err := commandConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	s, err := commandServer(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	for _, st := range s.stores {
+		res, err := serve.GarbageCollect(ctx, st.storage, serve.GCOptions{GracePeriod: *grace, DryRun: *dryRun})
+		slog.InfoContext(ctx, "gc done",
+			"namespaces", st.namespaces(),
+			"tagPointers", res.TagPointers,
+			"blobs", res.Blobs,
+			"reachable", res.Reachable,
+			"deleted", res.Deleted,
+			"deletedBytes", res.DeletedBytes,
+			"deletedLinks", res.DeletedLinks,
+			"dryRun", *dryRun)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
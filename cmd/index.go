@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+
+	"github.com/tuananh/helm-oci-proxy/pkg/serve"
+)
+
+// runIndex prints the metadata index as JSON lines. With -rebuild, the index
+// is first brought up to date with the tag pointers in storage, e.g. for
+// caches written before the index existed.
+func runIndex(ctx context.Context, args []string) error {
+	fs, configFile := newFlagSet("index")
+	rebuild := fs.Bool("rebuild", false, "Index tag pointers missing from the index, link their blobs and drop stale entries")
+	fs.Parse(args)
+
+	config, err := commandConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	s, err := commandServer(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, ns := range s.namespaces() {
+		st := s.storeFor(ns).storage
+		if *rebuild {
+			if err := rebuildIndex(ctx, st, ns); err != nil {
+				return err
+			}
+		}
+		if err := serve.ListIndex(ctx, st, ns, func(e serve.IndexEntry) error {
+			return enc.Encode(e)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildIndex indexes the tag pointers of namespace that have no index entry
+// and removes entries whose tag pointer is gone. It also links every indexed
+// chart version into its repository.
+func rebuildIndex(ctx context.Context, st serve.StorageBackend, namespace string) error {
+	added, removed := 0, 0
+	if err := st.List(ctx, namespace+"/tags/", func(name string) error {
+		e, err := serve.ReadIndexEntry(ctx, st, name)
+		if errors.Is(err, serve.ErrBlobUnknown) {
+			if e, err = serve.IndexTag(ctx, st, name, "", ""); err != nil {
+				slog.WarnContext(ctx, "index: failed to index tag pointer", "name", name, "err", err)
+				return nil
+			}
+			added++
+		} else if err != nil {
+			return err
+		}
+		return serve.LinkManifest(ctx, st, e.Namespace+"/"+e.Chart, name)
+	}); err != nil {
+		return err
+	}
+
+	var stale []string
+	if err := serve.ListIndex(ctx, st, namespace, func(e serve.IndexEntry) error {
+		if _, err := st.Stat(ctx, e.TagName); errors.Is(err, serve.ErrBlobUnknown) {
+			stale = append(stale, e.TagName)
+		} else if err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, name := range stale {
+		if err := st.Delete(ctx, serve.IndexName(name)); err != nil {
+			return err
+		}
+		removed++
+	}
+	slog.InfoContext(ctx, "index rebuilt", "namespace", namespace, "added", added, "removed", removed)
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/tuananh/helm-oci-proxy/pkg/limit"
+	"github.com/tuananh/helm-oci-proxy/pkg/types"
+)
+
+// defaultQuotaWindow is the window of build quotas if none is configured.
+const defaultQuotaWindow = time.Hour
+
+// withRateLimit returns next behind the request rate limit per client, keyed
+// by identity, so it goes inside authentication. Build quotas are set on s and
+// checked on cache misses.
+func withRateLimit(config types.RateLimitConfig, s *server, next http.Handler) http.Handler {
+	window := config.Window
+	if window <= 0 {
+		window = defaultQuotaWindow
+	}
+	if config.Builds > 0 {
+		s.clientBuilds = limit.NewQuota(config.Builds, window)
+	}
+	if config.NamespaceBuilds > 0 {
+		s.namespaceBuilds = limit.NewQuota(config.NamespaceBuilds, window)
+	}
+	if config.Requests <= 0 {
+		return next
+	}
+	l := limit.NewLimiter(config.Requests, burstOf(config.Requests, config.Burst), func(r *http.Request) string {
+		return limit.ClientKey(r, s.trustForwardedFor)
+	})
+	return l.Wrap(next)
+}
+
+// withAddrRateLimit returns next behind the request rate limit per client
+// address. It goes outside authentication, so that failed attempts and the
+// token endpoint are limited too. It defaults to the limit per client.
+func withAddrRateLimit(config types.RateLimitConfig, trustForwardedFor bool, next http.Handler) http.Handler {
+	requests, burst := config.AddrRequests, config.AddrBurst
+	if requests <= 0 {
+		requests, burst = config.Requests, config.Burst
+	}
+	if requests <= 0 {
+		return next
+	}
+	l := limit.NewLimiter(requests, burstOf(requests, burst), func(r *http.Request) string {
+		return "ip:" + limit.ClientAddr(r, trustForwardedFor)
+	})
+	return l.Wrap(next)
+}
+
+// burstOf defaults a burst to twice the rate.
+func burstOf(requests float64, burst int) int {
+	if burst <= 0 {
+		return max(1, int(2*requests))
+	}
+	return burst
+}
+
+// quotaError is returned by builds that a quota refused.
+type quotaError struct {
+	what  string
+	retry time.Duration // Until the window of the quota ends
+}
+
+func (e *quotaError) Error() string { return e.what }
+
+// chargeBuild records a fetch from upstream of a chart version of namespace
+// for client, or returns a *quotaError if a quota refuses it. Both quotas are
+// checked before either is charged, so that a build one of them refuses
+// doesn't use up the other. It is only called by the request that builds,
+// not by those that wait for its build.
+func (s *server) chargeBuild(client, namespace string) error {
+	refuse := func(retry time.Duration, q *limit.Quota) error {
+		what := "upstream fetch quota exceeded"
+		if q == s.namespaceBuilds {
+			what = "upstream fetch quota of namespace " + namespace + " exceeded"
+		}
+		return &quotaError{what: what, retry: retry}
+	}
+	if s.clientBuilds != nil {
+		if ok, retry := s.clientBuilds.Check(client); !ok {
+			return refuse(retry, s.clientBuilds)
+		}
+	}
+	if s.namespaceBuilds != nil {
+		if ok, retry := s.namespaceBuilds.Check(namespace); !ok {
+			return refuse(retry, s.namespaceBuilds)
+		}
+	}
+
+	// Concurrent builds may have used up a quota since it was checked.
+	if s.clientBuilds != nil {
+		if ok, retry := s.clientBuilds.Allow(client); !ok {
+			return refuse(retry, s.clientBuilds)
+		}
+	}
+	if s.namespaceBuilds != nil {
+		if ok, retry := s.namespaceBuilds.Allow(namespace); !ok {
+			if s.clientBuilds != nil {
+				s.clientBuilds.Refund(client)
+			}
+			return refuse(retry, s.namespaceBuilds)
+		}
+	}
+	return nil
+}
+
+// refundBuild takes back a build charged by chargeBuild, for versions the
+// upstream doesn't have.
+func (s *server) refundBuild(client, namespace string) {
+	if s.clientBuilds != nil {
+		s.clientBuilds.Refund(client)
+	}
+	if s.namespaceBuilds != nil {
+		s.namespaceBuilds.Refund(namespace)
+	}
+}
@@ -4,15 +4,22 @@ import (
 	"bytes"
 	"context"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
@@ -22,14 +29,23 @@ import (
 	v1tar "github.com/google/go-containerregistry/pkg/v1/tarball"
 
 	ocitypes "github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/tuananh/helm-oci-proxy/pkg/audit"
+	"github.com/tuananh/helm-oci-proxy/pkg/auth"
+	"github.com/tuananh/helm-oci-proxy/pkg/certs"
 	"github.com/tuananh/helm-oci-proxy/pkg/helm"
+	"github.com/tuananh/helm-oci-proxy/pkg/limit"
 	"github.com/tuananh/helm-oci-proxy/pkg/serve"
 	"github.com/tuananh/helm-oci-proxy/pkg/types"
+	"golang.org/x/sync/singleflight"
 	"gopkg.in/yaml.v3"
 	"helm.sh/helm/v3/pkg/chart/loader"
 	"k8s.io/apimachinery/pkg/util/json"
 )
 
+// buildPollInterval is how often a replica waiting for a build on another
+// replica checks whether it is done.
+const buildPollInterval = 500 * time.Millisecond
+
 // so we dont have to import helm.sh/helm/v3/pkg/registry
 const (
 	ChartLayerMediaType = "application/vnd.oci.image.layer.v1.tar+gzip"
@@ -39,18 +55,20 @@ const (
 func main() {
 	ctx := context.Background()
 
+	// Maintenance commands, e.g. `helm-oci-proxy migrate-layout -config config.yaml`
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		if err := runCommand(ctx, os.Args[1], os.Args[2:]); err != nil {
+			slog.ErrorContext(ctx, os.Args[1], "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Define command line flags
 	configFile := flag.String("config", "", "Path to config file")
 	flag.Parse()
 
-	// Initialize default config
-	config := types.Config{
-		Port:         "5000",
-		Repositories: []types.RepoConfig{},
-		Storage: types.StorageConfig{
-			Type: "gcs", // Default to GCS for backward compatibility
-		},
-	}
+	config := defaultConfig()
 
 	// Load config from file if provided
 	if *configFile != "" {
@@ -68,24 +86,101 @@ func main() {
 	}
 
 	// Initialize storage based on configuration
-	st, err := serve.NewStorageWithConfig(ctx, config.Storage)
+	stores, err := openStores(ctx, config, serve.NewStorageWithConfig)
 	if err != nil {
 		slog.ErrorContext(ctx, "serve.NewStorageWithConfig", "err", err)
 		os.Exit(1)
 	}
+	for _, st := range stores {
+		st.access = serve.NewAccessLog(st.storage, time.Hour)
+		st.legacyTags = legacyTags(ctx, config, st.storage)
+		if config.Lock != nil {
+			st.locker, err = serve.NewLocker(ctx, *config.Lock, st.storage)
+			if err != nil {
+				slog.ErrorContext(ctx, "serve.NewLocker", "err", err)
+				os.Exit(1)
+			}
+		}
+	}
 
-	http.Handle("/v2/", &server{
-		info:    log.New(os.Stdout, "I ", log.Ldate|log.Ltime|log.Lshortfile),
-		error:   log.New(os.Stderr, "E ", log.Ldate|log.Ltime|log.Lshortfile),
-		storage: st,
-		config:  config,
-	})
+	if config.RetentionInterval > 0 {
+		go retentionLoop(ctx, stores, config.RetentionInterval)
+	}
+
+	var acl *auth.ACL
+	if config.ACL != nil {
+		acl, err = auth.NewACL(*config.ACL)
+		if err != nil {
+			slog.ErrorContext(ctx, "auth.NewACL", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	s := &server{
+		info:   log.New(os.Stdout, "I ", log.Ldate|log.Ltime|log.Lshortfile),
+		error:  log.New(os.Stderr, "E ", log.Ldate|log.Ltime|log.Lshortfile),
+		stores: stores,
+		config: config,
+		acl:    acl,
+
+		trustForwardedFor: config.TrustForwardedFor,
+	}
+	if config.Audit != nil {
+		s.auditor, err = audit.NewSink(ctx, *config.Audit)
+		if err != nil {
+			slog.ErrorContext(ctx, "audit.NewSink", "err", err)
+			os.Exit(1)
+		}
+	}
+	var handler http.Handler = s
+	if config.RateLimit != nil {
+		// Inside authentication, so that clients are limited by identity.
+		// Addresses are limited outside it, see withAddrRateLimit.
+		handler = withRateLimit(*config.RateLimit, s, handler)
+	}
+	if config.Auth != nil {
+		handler, err = withAuth(ctx, *config.Auth, acl, handler)
+		if err != nil {
+			slog.ErrorContext(ctx, "auth", "err", err)
+			os.Exit(1)
+		}
+	}
+	http.Handle("/v2/", handler)
 	http.Handle("/", http.RedirectHandler("https://github.com/tuananh/oci-helm-proxy", http.StatusSeeOther))
 
-	slog.InfoContext(ctx, "Listening...", "port", config.Port)
+	srv := &http.Server{Addr: fmt.Sprintf(":%s", config.Port)}
+	if config.RateLimit != nil {
+		srv.Handler = withAddrRateLimit(*config.RateLimit, config.TrustForwardedFor, http.DefaultServeMux)
+	}
+	if config.TLS != nil {
+		srv.TLSConfig, err = certs.Config(*config.TLS)
+		if err != nil {
+			slog.ErrorContext(ctx, "certs.Config", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	slog.InfoContext(ctx, "Listening...", "port", config.Port, "tls", config.TLS != nil)
 	slog.InfoContext(ctx, "Proxy Helm repo:", "repositories", config.Repositories)
 	slog.InfoContext(ctx, "Storage configuration:", "type", config.Storage.Type, "bucket", config.Storage.Bucket)
-	slog.ErrorContext(ctx, "ListenAndServe", "err", http.ListenAndServe(fmt.Sprintf(":%s", config.Port), nil))
+	if srv.TLSConfig != nil {
+		// The certificate comes from the TLS config, so that it is reloaded.
+		slog.ErrorContext(ctx, "ListenAndServeTLS", "err", srv.ListenAndServeTLS("", ""))
+		return
+	}
+	slog.ErrorContext(ctx, "ListenAndServe", "err", srv.ListenAndServe())
+}
+
+// defaultConfig returns the configuration used for settings missing from the
+// config file.
+func defaultConfig() types.Config {
+	return types.Config{
+		Port:         "5000",
+		Repositories: []types.RepoConfig{},
+		Storage: types.StorageConfig{
+			Type: "gcs", // Default to GCS for backward compatibility
+		},
+	}
 }
 
 // loadConfig loads configuration from a YAML file
@@ -104,165 +199,661 @@ func loadConfig(filePath string, config *types.Config) error {
 
 type server struct {
 	info, error *log.Logger
-	storage     serve.StorageBackend
+	stores      []*store // the default storage comes first
 	config      types.Config
+	acl         *auth.ACL // nil lets every client pull everything
+
+	builds  singleflight.Group
+	linked  sync.Map // tag pointers known to be linked into their repository
+	charts  sync.Map // charts whose cached versions were all linked, by repository name
+	clients sync.Map // upstream clients by repository
+
+	auditor audit.Sink // nil if auditing is off
+
+	// Quotas of builds per client and per namespace, nil if unlimited.
+	clientBuilds, namespaceBuilds *limit.Quota
+
+	trustForwardedFor bool // take client addresses from X-Forwarded-For
 }
 
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	path := strings.TrimPrefix(r.URL.String(), "/v2/")
+	// The path, not the URL: a query string must not change the route.
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
 
-	switch {
-	case path == "":
+	switch path {
+	case "":
 		// API Version check.
 		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
 		return
-	case strings.Contains(path, "/blobs/"),
-		strings.Contains(path, "/manifests/sha256:"):
-		// Extract requested blob digest and redirect to serve it from GCS.
+	case "_catalog":
+		s.serveCatalog(w, r)
+		return
+	}
+
+	repoName, kind, ref, ok := route(path)
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err := serve.ValidateName(repoName); err != nil {
+		serve.Error(w, err)
+		return
+	}
+	if !s.allowed(r.Context(), repoName) {
+		serve.Error(w, serve.ErrDenied)
+		return
+	}
+
+	switch {
+	case kind == "tags":
+		s.serveTags(w, r, repoName)
+	case kind == "blobs", serve.IsDigestReference(ref):
+		// Serve the requested blob or manifest digest from storage.
 		// If it doesn't exist, this will return 404.
-		parts := strings.Split(r.URL.Path, "/")
-		digest := parts[len(parts)-1]
-		s.storage.Blob(w, r, digest)
-	case strings.Contains(path, "/manifests/"):
-		s.serveHelmManifest(w, r)
+		if err := serve.ValidateDigest(ref); err != nil {
+			serve.Error(w, err)
+			return
+		}
+		s.serveDigest(w, r, repoName, ref, kind == "blobs")
 	default:
-		http.Error(w, "Not found", http.StatusNotFound)
+		if err := serve.ValidateTag(ref); err != nil {
+			serve.Error(w, err)
+			return
+		}
+		s.serveHelmManifest(w, r, repoName, ref)
+	}
+}
+
+// route splits the path of a request below /v2/ into the repository name, the
+// kind of request ("manifests", "blobs" or "tags") and its reference, if it is
+// one of those.
+func route(path string) (repoName, kind, ref string, ok bool) {
+	if name, ok := strings.CutSuffix(path, "/tags/list"); ok && name != "" {
+		return name, "tags", "", true
 	}
+	parts := strings.Split(path, "/")
+	if len(parts) < 3 {
+		return "", "", "", false
+	}
+	kind, ref = parts[len(parts)-2], parts[len(parts)-1]
+	if kind != "manifests" && kind != "blobs" || ref == "" {
+		return "", "", "", false
+	}
+	return strings.Join(parts[:len(parts)-2], "/"), kind, ref, true
 }
 
-func (s *server) serveHelmManifest(w http.ResponseWriter, r *http.Request) {
+// serveHelmManifest serves the manifest of version tagOrDigest of the chart
+// repoName ("<namespace>/<chart>"), building it from upstream if it is not
+// cached yet.
+func (s *server) serveHelmManifest(w http.ResponseWriter, r *http.Request, repoName, tagOrDigest string) {
 	ctx := r.Context()
 
-	path := strings.TrimPrefix(r.URL.Path, "/v2/")
-	parts := strings.Split(path, "/")
+	slog.InfoContext(ctx, "serveHelmManifest",
+		"method", r.Method,
+		"path", r.URL.Path,
+		"repoName", repoName,
+		"tagOrDigest", tagOrDigest)
 
-	// Validate OCI registry path format: repository/manifests/reference
-	// Example: v2/cert-manager/manifests/v1.0.0
-	if len(parts) < 3 || parts[len(parts)-2] != "manifests" {
-		slog.ErrorContext(ctx, "Invalid registry path format",
-			"path", path,
-			"expected", "repository/manifests/reference")
+	// Find the appropriate repo based on the namespace
+	repo, chartName, ok := s.findRepo(repoName)
+	if !ok {
+		slog.ErrorContext(ctx, "No matching repository found for chart", "repoName", repoName)
 		serve.Error(w, serve.ErrNotFound)
 		return
 	}
 
-	chartName := parts[1]              // repository name
-	tagOrDigest := parts[len(parts)-1] // version or digest
+	st := s.storeFor(repo.Prefix)
+	ck := tagName(repo, chartName, tagOrDigest)
 
-	slog.InfoContext(ctx, "serveHelmManifest",
-		"method", r.Method,
-		"URL", r.URL,
-		"chartName", chartName,
-		"tagOrDigest", tagOrDigest)
+	e := s.pullEvent(r, repo.Prefix, chartName, tagOrDigest)
 
-	// If request is for image by digest, try to serve it from GCS.
-	if strings.HasPrefix(tagOrDigest, "sha256:") {
-		desc, err := s.storage.BlobExists(ctx, tagOrDigest)
-		if err != nil {
-			slog.ErrorContext(ctx, "storage.BlobExists", err)
-			serve.Error(w, serve.ErrNotFound)
-			return
-		}
-		if r.Method == http.MethodHead {
-			w.Header().Set("Docker-Content-Digest", tagOrDigest)
-			w.Header().Set("Content-Type", string(desc.MediaType))
-			w.Header().Set("Content-Length", fmt.Sprintf("%d", desc.Size))
+	// Check if we've already got a manifest for this chart
+	if name, ok := s.cached(ctx, st, repo, chartName, tagOrDigest, ck); ok {
+		slog.InfoContext(ctx, "serving cached manifest:", "cacheKey", name)
+		s.link(ctx, st, repoName, name)
+		st.access.Touch(ctx, name)
+		serve.ServeManifest(w, r, st.storage, name)
+		e.Cache = audit.CacheHit
+		s.recordPull(ctx, w, st, name, e)
+		return
+	}
+
+	e.Cache = audit.CacheMiss
+
+	// Build the OCI helm chart, or wait for whoever is building it already
+	client := limit.ClientKey(r, s.trustForwardedFor)
+	if err := s.fill(ctx, st, repo, chartName, tagOrDigest, ck, client); err != nil {
+		var qerr *quotaError
+		if errors.As(err, &qerr) {
+			limit.TooManyRequests(w, qerr.retry, qerr.what)
 			return
 		}
-		s.storage.Blob(w, r, tagOrDigest)
+		slog.ErrorContext(ctx, "build: ", "err", err)
+		serve.Error(w, clientError(err))
+		e.Error = err.Error()
+		s.record(ctx, e)
 		return
 	}
 
-	// Find the appropriate repo based on prefix
-	var repoURL string
-	for _, repo := range s.config.Repositories {
-		if strings.HasPrefix(chartName, repo.Prefix) {
-			repoURL = repo.URL
-			break
-		}
+	serve.ServeManifest(w, r, st.storage, ck)
+	st.access.Touch(ctx, ck)
+	s.recordPull(ctx, w, st, ck, e)
+}
+
+var (
+	errUpstreamBlocked  = &serve.RegistryError{Code: "DENIED", Status: http.StatusForbidden, Message: "upstream download refused by outbound policy"}
+	errUpstreamTooLarge = &serve.RegistryError{Code: "UNKNOWN", Status: http.StatusBadGateway, Message: "upstream download too large"}
+)
+
+// clientError returns the error reported to clients for a failed build.
+// Refused and oversized downloads are reported without details, which could
+// reveal internal addresses; those are logged instead.
+func clientError(err error) error {
+	switch {
+	case errors.Is(err, helm.ErrBlocked):
+		return errUpstreamBlocked
+	case errors.Is(err, helm.ErrTooLarge):
+		return errUpstreamTooLarge
 	}
+	return err
+}
 
-	if repoURL == "" {
-		slog.ErrorContext(ctx, "No matching repository found for chart", "chartName", chartName)
-		serve.Error(w, serve.ErrNotFound)
+// recordPull audits a manifest served from the tag pointer ck, with the
+// digest served and where the chart came from.
+func (s *server) recordPull(ctx context.Context, w http.ResponseWriter, st *store, ck string, e audit.Event) {
+	if s.auditor == nil {
 		return
 	}
+	e.Digest = w.Header().Get("Docker-Content-Digest")
+	if ie, err := serve.ReadIndexEntry(ctx, st.storage, ck); err == nil {
+		e.Upstream, e.Verification = ie.Upstream, ie.Verification
+	} else if !errors.Is(err, serve.ErrBlobUnknown) {
+		slog.WarnContext(ctx, "failed to read index entry for audit", "name", ck, "err", err)
+	}
+	s.record(ctx, e)
+}
 
-	cacheKey := []string{chartName, tagOrDigest}
-	ck := makeCacheKey(cacheKey)
-
-	// Check if we've already got a manifest for this chart
-	if _, err := s.storage.BlobExists(ctx, ck); err == nil {
-		slog.InfoContext(ctx, "serving cached manifest:", "cacheKey", ck)
-		s.storage.Blob(w, r, ck)
+// record sends e to the audit sink, as the client of ctx. Failures are
+// logged: the request has been served already.
+func (s *server) record(ctx context.Context, e audit.Event) {
+	if s.auditor == nil {
 		return
 	}
+	e.Time = time.Now().UTC()
+	if id, ok := auth.FromContext(ctx); ok {
+		e.Subject = id.Subject
+	}
+	if err := s.auditor.Record(ctx, e); err != nil {
+		slog.ErrorContext(ctx, "failed to record audit event", "action", e.Action, "err", err)
+	}
+}
 
-	// Build the OCI helm chart
-	img, err := s.build(ctx, repoURL, chartName, tagOrDigest)
+// serveDigest serves a blob, or a manifest by digest, if it is linked into
+// the repository repoName. Blobs of other repositories are reported unknown,
+// as if they did not exist.
+func (s *server) serveDigest(w http.ResponseWriter, r *http.Request, repoName, digest string, blob bool) {
+	unknown := serve.ErrManifestUnknown
+	if blob {
+		unknown = serve.ErrBlobUnknown
+	}
+	st := s.storeOf(repoName)
+	ok, err := serve.Linked(r.Context(), st.storage, repoName, digest)
+	if err == nil && !ok && s.linkChart(r.Context(), st, repoName) {
+		ok, err = serve.Linked(r.Context(), st.storage, repoName, digest)
+	}
 	if err != nil {
-		slog.ErrorContext(ctx, "build: ", "err", err)
+		slog.ErrorContext(r.Context(), "serve.Linked", "repoName", repoName, "digest", digest, "err", err)
 		serve.Error(w, err)
 		return
+	} else if !ok {
+		serve.Error(w, unknown)
+		return
+	}
+	if blob {
+		serve.ServeBlob(w, r, st.storage, digest)
+		return
 	}
+	serve.ServeManifest(w, r, st.storage, digest)
+	s.recordDigestPull(r, st, repoName, digest)
+}
 
-	if err := s.storage.ServeManifest(w, r, img, ck); err != nil {
-		slog.ErrorContext(ctx, "storage.ServeManifest:", "err", err)
+// recordDigestPull audits a manifest served by digest. The version, and
+// where it came from, are looked up from the chart metadata.
+func (s *server) recordDigestPull(r *http.Request, st *store, repoName, digest string) {
+	if s.auditor == nil {
+		return
+	}
+	ctx := r.Context()
+	e := s.pullEvent(r, path.Dir(repoName), path.Base(repoName), "")
+	e.Cache, e.Digest = audit.CacheHit, digest
+	md, err := serve.ReadChartMetadata(ctx, st.storage, digest)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to read chart metadata for audit", "name", digest, "err", err)
+		s.record(ctx, e)
+		return
+	}
+	e.Version = md.Version
+	if repo, chartName, ok := s.findRepo(repoName); ok {
+		if ie, err := serve.ReadIndexEntry(ctx, st.storage, tagName(repo, chartName, md.Version)); err == nil {
+			e.Upstream, e.Verification = ie.Upstream, ie.Verification
+		}
+	}
+	s.record(ctx, e)
+}
+
+// pullEvent returns the audit event of a manifest request.
+func (s *server) pullEvent(r *http.Request, namespace, chartName, version string) audit.Event {
+	return audit.Event{
+		Action:    audit.ActionPull,
+		Client:    limit.ClientAddr(r, s.trustForwardedFor),
+		Method:    r.Method,
+		Namespace: namespace,
+		Chart:     chartName,
+		Version:   version,
+	}
+}
+
+// link links the chart version behind the tag pointer ck into repoName, for
+// versions cached before links were recorded. Each pointer is only checked
+// once per process.
+func (s *server) link(ctx context.Context, st *store, repoName, ck string) {
+	if _, ok := s.linked.Load(ck); ok {
+		return
+	}
+	if err := serve.LinkManifest(ctx, st.storage, repoName, ck); err != nil {
+		slog.WarnContext(ctx, "failed to link cached chart version", "name", ck, "err", err)
+		return
+	}
+	s.linked.Store(ck, true)
+}
+
+// linkChart links the cached versions of the chart repoName, so that those
+// cached before links were recorded can be pulled by digest before they are
+// pulled by tag. It reports whether it linked any; each chart is scanned
+// once per process, or until it has cached versions.
+func (s *server) linkChart(ctx context.Context, st *store, repoName string) bool {
+	if _, ok := s.charts.Load(repoName); ok {
+		return false
+	}
+	repo, chartName, ok := s.findRepo(repoName)
+	if !ok {
+		return false
+	}
+	var names []string
+	if err := st.storage.List(ctx, tagName(repo, chartName, ""), func(name string) error {
+		names = append(names, name)
+		return nil
+	}); err != nil {
+		slog.WarnContext(ctx, "failed to list cached chart versions", "repoName", repoName, "err", err)
+		return false
+	}
+	if len(names) == 0 {
+		return false
+	}
+	for _, name := range names {
+		s.link(ctx, st, repoName, name)
+	}
+	s.charts.Store(repoName, true)
+	return true
+}
+
+// cached returns the name of the tag pointer to serve for a chart version,
+// or false if it isn't cached. That is ck or, until migrate-tags has moved
+// them, the md5 key earlier releases used in the namespace. Old pointers are
+// served where they are.
+func (s *server) cached(ctx context.Context, st *store, repo types.RepoConfig, chartName, version, ck string) (string, bool) {
+	names := []string{ck}
+	if st.legacyTags {
+		names = append(names, legacyTagName(repo, chartName, version))
+	}
+	for _, name := range names {
+		if _, err := st.storage.Stat(ctx, name); err == nil {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// fill builds a chart version and stores it under the tag pointer ck.
+// Concurrent requests for the same version share one build, and with a
+// locker, so do the replicas: only the one holding the build lease builds,
+// the others wait for its tag pointer to appear. The build is charged to the
+// quotas of client, the client that started it, and refunded if the upstream
+// doesn't have the version.
+func (s *server) fill(ctx context.Context, st *store, repo types.RepoConfig, chartName, version, ck, client string) error {
+	ch := s.builds.DoChan(ck, func() (any, error) {
+		// The build is shared, so it must not fail because the client that
+		// started it went away.
+		ctx := context.WithoutCancel(ctx)
+
+		if st.locker != nil {
+			lease, built, err := s.acquire(ctx, st, ck)
+			if err != nil || built {
+				return nil, err
+			}
+			if lease != nil {
+				defer s.keep(ctx, lease, ck)()
+			}
+		}
+
+		if err := s.chargeBuild(client, repo.Prefix); err != nil {
+			return nil, err
+		}
+		img, o, err := s.build(ctx, repo, chartName, version)
+		if errors.Is(err, helm.ErrNotFound) {
+			s.refundBuild(client, repo.Prefix)
+		}
+		if err == nil {
+			err = s.write(ctx, st, repo.Prefix+"/"+chartName, img, ck)
+		}
+		e := audit.Event{
+			Action:       audit.ActionBuild,
+			Namespace:    repo.Prefix,
+			Chart:        chartName,
+			Version:      version,
+			Upstream:     o.URL,
+			Verification: o.Verification,
+		}
+		if err != nil {
+			e.Error = err.Error()
+			s.record(ctx, e)
+			return nil, err
+		}
+		if digest, err := img.Digest(); err == nil {
+			e.Digest = digest.String()
+		}
+		s.record(ctx, e)
+		s.index(ctx, st, ck, o)
+		return nil, nil
+	})
+	select {
+	case res := <-ch:
+		return res.Err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// write stores img under the tag pointer ck and links it into the repository
+// repoName. The links are written before the pointer, so that clients that
+// see the pointer can fetch its blobs.
+func (s *server) write(ctx context.Context, st *store, repoName string, img v1.Image, ck string) error {
+	if err := serve.WriteImage(ctx, st.storage, img); err != nil {
+		return err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	if err := serve.LinkManifest(ctx, st.storage, repoName, digest.String()); err != nil {
+		return err
+	}
+	if err := serve.WriteImage(ctx, st.storage, img, ck); err != nil {
+		return err
+	}
+	s.linked.Store(ck, true)
+	return nil
+}
+
+// acquire takes the build lease for the tag pointer ck, waiting while
+// another replica holds it. It reports built if ck was written in the
+// meantime. If the locker fails, it returns no lease and the caller builds
+// anyway: a duplicate build is harmless, a failed pull is not.
+func (s *server) acquire(ctx context.Context, st *store, ck string) (serve.Lease, bool, error) {
+	ttl := s.leaseTTL()
+	for {
+		lease, ok, err := st.locker.TryLock(ctx, serve.LockName(ck), ttl)
+		if err != nil {
+			slog.WarnContext(ctx, "failed to take build lease, building anyway", "name", ck, "err", err)
+			return nil, false, nil
+		}
+		if ok {
+			// The previous holder may have finished just before we got here.
+			if _, err := st.storage.Stat(ctx, ck); err == nil {
+				if err := lease.Release(ctx); err != nil {
+					slog.WarnContext(ctx, "failed to release build lease", "name", ck, "err", err)
+				}
+				return nil, true, nil
+			}
+			return lease, false, nil
+		}
+
+		slog.InfoContext(ctx, "waiting for build on another replica", "name", ck)
+		time.Sleep(buildPollInterval)
+		if _, err := st.storage.Stat(ctx, ck); err == nil {
+			return nil, true, nil
+		} else if !errors.Is(err, serve.ErrBlobUnknown) {
+			return nil, false, err
+		}
+	}
+}
+
+// leaseTTL returns how long a build lease is taken for.
+func (s *server) leaseTTL() time.Duration {
+	if s.config.Lock.TTL > 0 {
+		return s.config.Lock.TTL
+	}
+	return 5 * time.Minute
+}
+
+// keep renews the build lease for the tag pointer ck while the build runs,
+// so that a build taking longer than the TTL isn't taken over by another
+// replica. The returned function stops renewing and releases the lease.
+func (s *server) keep(ctx context.Context, lease serve.Lease, ck string) func() {
+	ttl := s.leaseTTL()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(ttl / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			if err := lease.Renew(ctx, ttl); errors.Is(err, serve.ErrLeaseLost) {
+				slog.WarnContext(ctx, "lost build lease, another replica may build too", "name", ck)
+				return
+			} else if err != nil {
+				slog.WarnContext(ctx, "failed to renew build lease", "name", ck, "err", err)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		if err := lease.Release(ctx); err != nil {
+			slog.WarnContext(ctx, "failed to release build lease", "name", ck, "err", err)
+		}
+	}
+}
+
+// index records the chart version behind the tag pointer ck, and where it came
+// from, in the metadata index. The index is only informational, so failures
+// are just logged.
+func (s *server) index(ctx context.Context, st *store, ck string, o origin) {
+	if _, err := serve.IndexTag(ctx, st.storage, ck, o.URL, o.Verification); err != nil {
+		slog.WarnContext(ctx, "failed to update index", "name", ck, "err", err)
+	}
+}
+
+// serveCatalog lists the charts cached in the configured namespaces.
+func (s *server) serveCatalog(w http.ResponseWriter, r *http.Request) {
+	var repos []string
+	for _, st := range s.stores {
+		names, err := serve.Repositories(r.Context(), st.storage, st.namespaces())
+		if err != nil {
+			slog.ErrorContext(r.Context(), "serve.Repositories", "err", err)
+			serve.Error(w, err)
+			return
+		}
+		for _, name := range names {
+			if s.allowed(r.Context(), name) {
+				repos = append(repos, name)
+			}
+		}
+	}
+	sort.Strings(repos)
+	serve.ServeCatalog(w, r, repos)
+}
+
+// serveTags lists the cached versions of the chart repoName.
+func (s *server) serveTags(w http.ResponseWriter, r *http.Request, repoName string) {
+	repo, chartName, ok := s.findRepo(repoName)
+	if !ok {
+		serve.Error(w, serve.ErrNameUnknown)
+		return
+	}
+	tags, err := serve.Tags(r.Context(), s.storeFor(repo.Prefix).storage, repo.Prefix, chartName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "serve.Tags", "err", err)
 		serve.Error(w, err)
+		return
+	}
+	if len(tags) == 0 {
+		serve.Error(w, serve.ErrNameUnknown)
+		return
 	}
+	serve.ServeTags(w, r, repoName, tags)
 }
 
-// Download the Helm chart and package it into v1.Image
-func (s *server) build(ctx context.Context, repoURL string, chartName string, chartVersion string) (v1.Image, error) {
-	slog.InfoContext(ctx, "build", "repoURL", repoURL, "chartName", chartName, "chartVersion", chartVersion)
+// allowed reports whether the client of a request may pull from the
+// repository name.
+func (s *server) allowed(ctx context.Context, name string) bool {
+	id, _ := auth.FromContext(ctx)
+	if !id.InNamespaces(name) {
+		return false
+	}
+	return s.acl == nil || s.acl.Allows(id, name, "pull")
+}
 
-	wd, err := os.MkdirTemp("", "helm-oci-proxy-*")
+// namespaces returns the namespaces of the configured repositories.
+func (s *server) namespaces() []string {
+	var nss []string
+	for _, repo := range s.config.Repositories {
+		if !slices.Contains(nss, repo.Prefix) {
+			nss = append(nss, repo.Prefix)
+		}
+	}
+	return nss
+}
+
+// findRepo returns the repository whose prefix is the namespace of repoName,
+// along with the chart name within that namespace.
+func (s *server) findRepo(repoName string) (types.RepoConfig, string, bool) {
+	for _, repo := range s.config.Repositories {
+		if chartName, ok := strings.CutPrefix(repoName, repo.Prefix+"/"); ok && chartName != "" {
+			return repo, chartName, true
+		}
+	}
+	return types.RepoConfig{}, "", false
+}
+
+// upstream returns the client of the upstream repository of repo. Clients are
+// kept so that connections to upstream are reused.
+func (s *server) upstream(repo types.RepoConfig) (*helm.Client, error) {
+	key := repo.Prefix + " " + repo.URL
+	if c, ok := s.clients.Load(key); ok {
+		return c.(*helm.Client), nil
+	}
+	c, err := helm.NewClient(repo.URL, helm.Policy{
+		AllowedHosts:         repo.AllowedHosts,
+		AllowPrivateNetworks: s.config.Outbound.AllowPrivateNetworks,
+		MaxRedirects:         s.config.Outbound.MaxRedirects,
+		MaxDownloadSize:      s.config.Outbound.MaxDownloadSize,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to create working directory: %w", err)
+		return nil, err
 	}
+	actual, _ := s.clients.LoadOrStore(key, c)
+	return actual.(*helm.Client), nil
+}
 
-	// defer os.RemoveAll(wd)
+// origin is where a build got its chart from.
+type origin struct {
+	URL          string
+	Verification string // helm.Verified, helm.Unverified or helm.Mismatch
+}
+
+// Download the Helm chart and package it into v1.Image. It also returns where
+// the chart was downloaded from.
+func (s *server) build(ctx context.Context, repo types.RepoConfig, chartName string, chartVersion string) (v1.Image, origin, error) {
+	slog.InfoContext(ctx, "build", "repoURL", repo.URL, "chartName", chartName, "chartVersion", chartVersion)
+
+	var o origin
+	client, err := s.upstream(repo)
+	if err != nil {
+		return nil, o, err
+	}
+
+	wd, err := os.MkdirTemp("", "helm-oci-proxy-*")
+	if err != nil {
+		return nil, o, fmt.Errorf("failed to create working directory: %w", err)
+	}
+	defer os.RemoveAll(wd)
 
 	// Download the chart using the new package
-	chartReader, err := helm.DownloadChart(repoURL, chartName, chartVersion)
+	chartURL, digest, err := client.Chart(ctx, chartName, chartVersion)
+	if err != nil {
+		return nil, o, fmt.Errorf("failed to download chart: %w", err)
+	}
+	o.URL = chartURL
+	chartReader, err := client.Download(ctx, chartURL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to download chart: %w", err)
+		return nil, o, fmt.Errorf("failed to download chart: %w", err)
 	}
 	defer chartReader.Close()
 
 	// Save the chart to a temporary file
-	chartPath := path.Join(wd, fmt.Sprintf("%s-%s.tgz", chartName, chartVersion))
+	// Nothing from the request goes into the path.
+	chartPath := path.Join(wd, "chart.tgz")
 	chartFile, err := os.Create(chartPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create chart file: %w", err)
+		return nil, o, fmt.Errorf("failed to create chart file: %w", err)
 	}
 
-	if _, err := io.Copy(chartFile, chartReader); err != nil {
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(chartFile, h), chartReader); err != nil {
 		chartFile.Close()
-		return nil, fmt.Errorf("failed to save chart file: %w", err)
+		return nil, o, fmt.Errorf("failed to save chart file: %w", err)
 	}
 	chartFile.Close()
 
+	// Check the chart against the digest in the index, if it lists one.
+	o.Verification = helm.Unverified
+	if digest != "" {
+		if got := hex.EncodeToString(h.Sum(nil)); got != digest {
+			o.Verification = helm.Mismatch
+			return nil, o, fmt.Errorf("%w: %s is sha256:%s, index says sha256:%s", helm.ErrDigestMismatch, chartURL, got, digest)
+		}
+		o.Verification = helm.Verified
+	}
+
 	// Read the chart file
 	chartBytes, err := os.ReadFile(chartPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read chart from file: %w", err)
+		return nil, o, fmt.Errorf("failed to read chart from file: %w", err)
 	}
 
 	ch, err := loader.LoadArchive(bytes.NewReader(chartBytes))
 	if err != nil {
-		return nil, fmt.Errorf("failed to load chart: %w", err)
+		return nil, o, fmt.Errorf("failed to load chart: %w", err)
 	}
 
 	configData, err := json.Marshal(ch.Metadata)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal chart metadata: %w", err)
+		return nil, o, fmt.Errorf("failed to marshal chart metadata: %w", err)
 	}
 
 	// we create 2 layers: config & chart layer content
-	v1Layer, err := v1tar.LayerFromFile(chartPath, v1tar.WithMediaType(ChartLayerMediaType))
+	// The layer is read again when the image is written, after wd is gone.
+	v1Layer, err := v1tar.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(chartBytes)), nil
+	}, v1tar.WithMediaType(ChartLayerMediaType))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create OCI layer from .tgz: %w", err)
+		return nil, o, fmt.Errorf("failed to create OCI layer from .tgz: %w", err)
 	}
 
 	configLayer := static.NewLayer(configData, ConfigMediaType)
@@ -288,14 +879,42 @@ func (s *server) build(ctx context.Context, repoURL string, chartName string, ch
 
 	v1Image, err := mutate.Append(empty.Image, adds...)
 	if err != nil {
-		return empty.Image, fmt.Errorf("unable to append OCI layer to empty image: %w", err)
+		return empty.Image, o, fmt.Errorf("unable to append OCI layer to empty image: %w", err)
 	}
 
 	v1Image = mutate.ConfigMediaType(v1Image, ConfigMediaType)
 	v1Image = mutate.MediaType(v1Image, ocitypes.OCIManifestSchema1)
 
 	slog.InfoContext(ctx, "build OCI helm chart completed")
-	return v1Image, nil
+	return v1Image, o, nil
+}
+
+// tagName returns the name of the tag pointer of a chart version of repo,
+// "<namespace>/tags/<upstream>/<chart>/<version>". The upstream is the host
+// and path of the repository URL, so that a namespace pointed at another
+// repository doesn't serve charts cached from the old one.
+func tagName(repo types.RepoConfig, chartName, version string) string {
+	return serve.TagName(repo.Prefix, upstreamKey(repo.URL)+"/"+chartName+"/"+version)
+}
+
+// upstreamKey turns a repository URL into a single readable key segment,
+// e.g. "charts.jetstack.io" or "example.com_charts".
+func upstreamKey(repoURL string) string {
+	u, err := url.Parse(repoURL)
+	if err != nil || u.Host == "" {
+		return url.PathEscape(repoURL)
+	}
+	key := u.Host
+	if p := strings.Trim(u.Path, "/"); p != "" {
+		key += "_" + strings.ReplaceAll(p, "/", "_")
+	}
+	return key
+}
+
+// legacyTagName returns the md5 based name earlier releases used for the tag
+// pointer of a chart version. It doesn't include the repository URL.
+func legacyTagName(repo types.RepoConfig, chartName, version string) string {
+	return serve.TagName(repo.Prefix, makeCacheKey([]string{chartName, version}))
 }
 
 func makeCacheKey(keys []string) string {
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/tuananh/helm-oci-proxy/pkg/serve"
+	"github.com/tuananh/helm-oci-proxy/pkg/types"
+	"gopkg.in/yaml.v3"
+)
+
+// runMigrate copies all content from one storage backend to another.
+func runMigrate(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := fs.String("from", "", "Storage config to copy from")
+	to := fs.String("to", "", "Storage config to copy to")
+	concurrency := fs.Int("concurrency", 8, "Number of objects copied in parallel")
+	dryRun := fs.Bool("dry-run", false, "Only log what would be copied")
+	fs.Parse(args)
+
+	if *from == "" || *to == "" {
+		return fmt.Errorf("-from and -to are required")
+	}
+	src, err := storageFromFile(ctx, *from)
+	if err != nil {
+		return fmt.Errorf("%s: %w", *from, err)
+	}
+	dst, err := storageFromFile(ctx, *to)
+	if err != nil {
+		return fmt.Errorf("%s: %w", *to, err)
+	}
+
+	res, err := serve.Copy(ctx, src, dst, serve.CopyOptions{Concurrency: *concurrency, DryRun: *dryRun})
+	slog.InfoContext(ctx, "migrate done",
+		"copied", res.Copied,
+		"skipped", res.Skipped,
+		"failed", res.Failed,
+		"bytes", res.Bytes,
+		"dryRun", *dryRun)
+	return err
+}
+
+// storageFromFile creates the storage described by a YAML file. The file is
+// either a full config file, whose storage section is used, or just the
+// storage section itself.
+func storageFromFile(ctx context.Context, path string) (serve.StorageBackend, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read storage config: %w", err)
+	}
+	var file struct {
+		Storage *types.StorageConfig `yaml:"storage"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse storage config: %w", err)
+	}
+	if file.Storage == nil {
+		file.Storage = &types.StorageConfig{}
+		if err := yaml.Unmarshal(data, file.Storage); err != nil {
+			return nil, fmt.Errorf("failed to parse storage config: %w", err)
+		}
+	}
+	return commandStorage(ctx, *file.Storage)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/tuananh/helm-oci-proxy/pkg/serve"
+)
+
+// runMigrateLayout copies a cache written with the old flat layout, where
+// everything lived under "blobs/" and tag pointers were not namespaced, into
+// the prefix and layout configured in the storage section. Objects keep their
+// names; tag pointers of the first releases, "helm-oci-proxy-<md5>", are
+// then moved to their current names by migrate-tags. The old objects are
+// left in place; a re-run skips what has already been copied.
+func runMigrateLayout(ctx context.Context, args []string) error {
+	fs, configFile := newFlagSet("migrate-layout")
+	dryRun := fs.Bool("dry-run", false, "Only log what would be copied")
+	fs.Parse(args)
+
+	config, err := commandConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	layout, err := serve.NewLayout(config.Storage)
+	if err != nil {
+		return err
+	}
+	raw, err := serve.NewBackend(ctx, config.Storage)
+	if err != nil {
+		return err
+	}
+	legacy := serve.NewLayoutStorage(raw, serve.Layout{})
+	target := serve.NewLayoutStorage(raw, layout)
+
+	var copied, skipped int
+	err = legacy.List(ctx, "", func(name string) error {
+		if !strings.HasPrefix(name, "sha256:") && !isBaselineTag(name) && !strings.Contains(name, "/") {
+			slog.WarnContext(ctx, "skipping unknown object", "name", name)
+			skipped++
+			return nil
+		}
+
+		from := "blobs/" + name
+		if layout.Key(name) == from {
+			return nil
+		}
+		if _, err := target.Stat(ctx, name); err == nil {
+			skipped++
+			return nil
+		}
+
+		slog.InfoContext(ctx, "copy", "from", from, "to", layout.Key(name), "dryRun", *dryRun)
+		if *dryRun {
+			return nil
+		}
+		if err := copyObject(ctx, legacy, name, target, name); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", from, err)
+		}
+		copied++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "migrate-layout done", "copied", copied, "skipped", skipped)
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/tuananh/helm-oci-proxy/pkg/serve"
+	"github.com/tuananh/helm-oci-proxy/pkg/types"
+	"helm.sh/helm/v3/pkg/chart"
+)
+
+// tagsMigratedName is written to a storage once migrate-tags has moved all of
+// its tag pointers, so that proxies started afterwards stop looking up the
+// keys of earlier releases.
+const tagsMigratedName = "_migrations/tags"
+
+// runMigrateTags moves tag pointers stored under the md5 keys of earlier
+// releases to their readable names: those in a namespace, and those of the
+// first releases without one. It is the only place old pointers are renamed;
+// once all of a storage's are moved, it records so in the storage.
+func runMigrateTags(ctx context.Context, args []string) error {
+	fs, configFile := newFlagSet("migrate-tags")
+	dryRun := fs.Bool("dry-run", false, "Only log what would be moved")
+	fs.Parse(args)
+
+	config, err := commandConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	s, err := commandServer(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	var moved, skipped int
+	for i, st := range s.stores {
+		m, sk, err := s.migrateTags(ctx, st, i == 0, *dryRun)
+		moved, skipped = moved+m, skipped+sk
+		if err != nil {
+			return err
+		}
+		if *dryRun {
+			continue
+		}
+		if sk > 0 {
+			slog.WarnContext(ctx, "some tag pointers were not moved, proxies keep looking up old keys", "namespaces", st.namespaces(), "skipped", sk)
+			continue
+		}
+		ts := time.Now().UTC().Format(time.RFC3339)
+		desc := serve.Descriptor{MediaType: "text/plain", Size: int64(len(ts))}
+		if err := st.storage.Put(ctx, tagsMigratedName, desc, strings.NewReader(ts)); err != nil {
+			return fmt.Errorf("failed to record migration: %w", err)
+		}
+	}
+	slog.InfoContext(ctx, "migrate-tags done", "moved", moved, "skipped", skipped, "dryRun", *dryRun)
+	return nil
+}
+
+// migrateTags moves the old tag pointers of st. Pointers of the first
+// releases have no namespace, and were only written to the default storage.
+func (s *server) migrateTags(ctx context.Context, st *store, isDefault, dryRun bool) (moved, skipped int, err error) {
+	type pointer struct {
+		from, to, repoName string
+	}
+	var pointers []pointer
+	for _, ns := range st.namespaces() {
+		var legacy []string
+		if err := st.storage.List(ctx, ns+"/tags/", func(name string) error {
+			if strings.HasPrefix(strings.TrimPrefix(name, ns+"/tags/"), "helm-oci-proxy-") {
+				legacy = append(legacy, name)
+			}
+			return nil
+		}); err != nil {
+			return moved, skipped, err
+		}
+		for _, name := range legacy {
+			md, err := serve.ReadChartMetadata(ctx, st.storage, name)
+			if err != nil {
+				slog.WarnContext(ctx, "skipping tag pointer", "name", name, "err", err)
+				skipped++
+				continue
+			}
+			repo, chartName, ok := s.findRepo(ns + "/" + md.Name)
+			if !ok {
+				return moved, skipped, fmt.Errorf("no repository configured for namespace %s", ns)
+			}
+			pointers = append(pointers, pointer{name, tagName(repo, chartName, md.Version), ""})
+		}
+	}
+
+	if isDefault {
+		var baseline []string
+		if err := st.storage.List(ctx, "helm-oci-proxy-", func(name string) error {
+			if isBaselineTag(name) {
+				baseline = append(baseline, name)
+			}
+			return nil
+		}); err != nil {
+			return moved, skipped, err
+		}
+		for _, name := range baseline {
+			repo, md, err := baselineTag(ctx, st.storage, s.config.Repositories, name)
+			if err != nil {
+				slog.WarnContext(ctx, "skipping tag pointer", "name", name, "err", err)
+				skipped++
+				continue
+			}
+			if s.storeFor(repo.Prefix) != st {
+				slog.WarnContext(ctx, "skipping tag pointer of a namespace with its own storage", "name", name, "namespace", repo.Prefix)
+				skipped++
+				continue
+			}
+			pointers = append(pointers, pointer{name, tagName(repo, md.Name, md.Version), repo.Prefix + "/" + md.Name})
+		}
+	}
+
+	for _, p := range pointers {
+		slog.InfoContext(ctx, "move", "from", p.from, "to", p.to, "dryRun", dryRun)
+		if dryRun {
+			continue
+		}
+		if err := serve.RenameTag(ctx, st.storage, p.from, p.to); err != nil {
+			return moved, skipped, fmt.Errorf("failed to move %s: %w", p.from, err)
+		}
+		// Pointers of the first releases predate links.
+		if p.repoName != "" {
+			if err := serve.LinkManifest(ctx, st.storage, p.repoName, p.to); err != nil {
+				return moved, skipped, fmt.Errorf("failed to link %s: %w", p.to, err)
+			}
+		}
+		moved++
+	}
+	return moved, skipped, nil
+}
+
+// legacyTags reports whether tag pointers under the md5 keys of earlier
+// releases are looked up in st: unless disabled, until migrate-tags has
+// moved them all.
+func legacyTags(ctx context.Context, config types.Config, st serve.StorageBackend) bool {
+	if config.DisableLegacyTags {
+		return false
+	}
+	_, err := st.Stat(ctx, tagsMigratedName)
+	if err != nil && !errors.Is(err, serve.ErrBlobUnknown) {
+		slog.WarnContext(ctx, "failed to check whether tag pointers were migrated", "err", err)
+	}
+	return err != nil
+}
+
+// hasBaselineTags reports whether the default storage st still holds tag
+// pointers of the first releases, which retention can't tell the namespace of.
+func hasBaselineTags(ctx context.Context, st serve.StorageBackend) (bool, error) {
+	if _, err := st.Stat(ctx, tagsMigratedName); err == nil {
+		return false, nil
+	}
+	found := errors.New("found")
+	err := st.List(ctx, "helm-oci-proxy-", func(name string) error {
+		if isBaselineTag(name) {
+			return found
+		}
+		return nil
+	})
+	if errors.Is(err, found) {
+		return true, nil
+	}
+	return false, err
+}
+
+// isBaselineTag reports whether name is a tag pointer of the first releases,
+// "helm-oci-proxy-<md5>" without a namespace.
+func isBaselineTag(name string) bool {
+	return strings.HasPrefix(name, "helm-oci-proxy-") && !strings.Contains(name, "/")
+}
+
+// baselineTag returns the repository and chart of a tag pointer of the first
+// releases. Their keys have no namespace, and a chart was fetched from the
+// first repository whose prefix was a prefix of the chart name; the same
+// rule tells where its content came from, so that it is moved to the
+// namespace of that upstream. The key is checked against the chart's name
+// and version.
+func baselineTag(ctx context.Context, st serve.StorageBackend, repos []types.RepoConfig, name string) (types.RepoConfig, *chart.Metadata, error) {
+	md, err := serve.ReadChartMetadata(ctx, st, name)
+	if err != nil {
+		return types.RepoConfig{}, nil, err
+	}
+	if makeCacheKey([]string{md.Name, md.Version}) != name {
+		return types.RepoConfig{}, nil, fmt.Errorf("key doesn't match chart %s version %s", md.Name, md.Version)
+	}
+	for _, repo := range repos {
+		if strings.HasPrefix(md.Name, repo.Prefix) {
+			return repo, md, nil
+		}
+	}
+	return types.RepoConfig{}, nil, fmt.Errorf("no repository matches chart %s", md.Name)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/tuananh/helm-oci-proxy/pkg/serve"
+	"github.com/tuananh/helm-oci-proxy/pkg/types"
+)
+
+// runResync brings a replica of replicated storage back in sync after an
+// outage, by mirroring another one.
+func runResync(ctx context.Context, args []string) error {
+	fs, configFile := newFlagSet("resync")
+	index := fs.Int("replica", -1, "Index of the replica to resync, as listed in the config")
+	from := fs.Int("from", -1, "Index of the replica to mirror, defaults to the first other one")
+	namespace := fs.String("namespace", "", "Resync the storage of this namespace instead of the default storage")
+	concurrency := fs.Int("concurrency", 8, "Number of objects copied in parallel")
+	dryRun := fs.Bool("dry-run", false, "Only log what would be copied or deleted")
+	fs.Parse(args)
+
+	config, err := commandConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	if *index < 0 {
+		return fmt.Errorf("-replica is required")
+	}
+	sc := config.Storage
+	if *namespace != "" {
+		i := slices.IndexFunc(config.Repositories, func(repo types.RepoConfig) bool {
+			return repo.Prefix == *namespace && repo.Storage != nil
+		})
+		if i < 0 {
+			return fmt.Errorf("namespace %s has no storage of its own", *namespace)
+		}
+		sc = *config.Repositories[i].Storage
+	}
+	layout, err := serve.NewLayout(sc)
+	if err != nil {
+		return err
+	}
+	// The replicas hold bucket keys, so work on the raw backend and only
+	// copy the keys under this deployment's prefix.
+	st, err := serve.NewBackend(ctx, sc)
+	if err != nil {
+		return err
+	}
+	replicated, ok := st.(*serve.ReplicatedStorage)
+	if !ok {
+		return fmt.Errorf("storage type %q is not replicated", sc.Type)
+	}
+	if *from < 0 {
+		*from = 0
+		if *index == 0 {
+			*from = 1
+		}
+	}
+	prefix := layout.Prefix
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	res, err := replicated.Resync(ctx, *index, *from, serve.CopyOptions{
+		Prefix:      prefix,
+		Concurrency: *concurrency,
+		DryRun:      *dryRun,
+	})
+	slog.InfoContext(ctx, "resync done",
+		"replica", *index,
+		"from", *from,
+		"copied", res.Copied,
+		"skipped", res.Skipped,
+		"failed", res.Failed,
+		"bytes", res.Bytes,
+		"deleted", res.Deleted,
+		"dryRun", *dryRun)
+	return err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/tuananh/helm-oci-proxy/pkg/serve"
+	"github.com/tuananh/helm-oci-proxy/pkg/types"
+)
+
+// runRetention applies the retention policies of the configured repositories
+// once and reports what it removes.
+func runRetention(ctx context.Context, args []string) error {
+	fs, configFile := newFlagSet("retention")
+	dryRun := fs.Bool("dry-run", false, "Only log what would be removed")
+	fs.Parse(args)
+
+	config, err := commandConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	s, err := commandServer(ctx, config)
+	if err != nil {
+		return err
+	}
+	return applyRetention(ctx, s.stores, *dryRun)
+}
+
+// applyRetention applies the retention policy of every repository that has
+// one. It refuses to run while the default storage holds tag pointers of the
+// first releases, which would never expire; migrate-tags moves them.
+func applyRetention(ctx context.Context, stores []*store, dryRun bool) error {
+	if baseline, err := hasBaselineTags(ctx, stores[0].storage); err != nil {
+		return fmt.Errorf("failed to look for tag pointers to migrate: %w", err)
+	} else if baseline {
+		return errors.New("the storage holds tag pointers of the first releases, run migrate-tags before retention")
+	}
+	for _, st := range stores {
+		if err := applyStoreRetention(ctx, st.storage, st.repos, dryRun); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyStoreRetention applies the retention policies of repos, whose charts
+// are stored in st.
+func applyStoreRetention(ctx context.Context, st serve.StorageBackend, repos []types.RepoConfig, dryRun bool) error {
+	for _, repo := range repos {
+		if repo.Retention == nil {
+			continue
+		}
+		decisions, err := serve.ApplyRetention(ctx, st, repo.Prefix, *repo.Retention, dryRun)
+		if err != nil {
+			return err
+		}
+		removed := 0
+		for _, d := range decisions {
+			if d.Keep {
+				continue
+			}
+			removed++
+			slog.InfoContext(ctx, "retention: remove",
+				"namespace", repo.Prefix,
+				"chart", d.Chart,
+				"version", d.Version,
+				"lastAccess", d.LastAccess,
+				"dryRun", dryRun)
+		}
+		slog.InfoContext(ctx, "retention done", "namespace", repo.Prefix, "pointers", len(decisions), "removed", removed, "dryRun", dryRun)
+	}
+	return nil
+}
+
+// retentionLoop applies the retention policies every interval until ctx is done.
+func retentionLoop(ctx context.Context, stores []*store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := applyRetention(ctx, stores, false); err != nil {
+				slog.ErrorContext(ctx, "retention", "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tuananh/helm-oci-proxy/pkg/serve"
+	"github.com/tuananh/helm-oci-proxy/pkg/types"
+)
+
+// store is a storage backend along with the repositories whose charts it
+// holds.
+type store struct {
+	storage serve.StorageBackend
+	repos   []types.RepoConfig
+
+	access *serve.AccessLog // records pulls; only set when serving
+	locker serve.Locker     // nil unless builds are coordinated between replicas
+
+	// legacyTags looks up tag pointers under the md5 keys of earlier
+	// releases too; only set when serving.
+	legacyTags bool
+}
+
+// openStores creates the storage backends of config with open: first the
+// default storage, then one for each repository that overrides it.
+func openStores(ctx context.Context, config types.Config, open func(context.Context, types.StorageConfig) (serve.StorageBackend, error)) ([]*store, error) {
+	st, err := open(ctx, config.Storage)
+	if err != nil {
+		return nil, err
+	}
+	stores := []*store{{storage: st}}
+	for _, repo := range config.Repositories {
+		if repo.Storage == nil {
+			stores[0].repos = append(stores[0].repos, repo)
+			continue
+		}
+		st, err := open(ctx, *repo.Storage)
+		if err != nil {
+			return nil, fmt.Errorf("storage of namespace %s: %w", repo.Prefix, err)
+		}
+		stores = append(stores, &store{storage: st, repos: []types.RepoConfig{repo}})
+	}
+	return stores, nil
+}
+
+// namespaces returns the namespaces held by the store.
+func (st *store) namespaces() []string {
+	nss := make([]string, 0, len(st.repos))
+	for _, repo := range st.repos {
+		nss = append(nss, repo.Prefix)
+	}
+	return nss
+}
+
+// storeFor returns the store of namespace, or the default store if no
+// repository has that namespace.
+func (s *server) storeFor(namespace string) *store {
+	for _, st := range s.stores {
+		for _, repo := range st.repos {
+			if repo.Prefix == namespace {
+				return st
+			}
+		}
+	}
+	return s.stores[0]
+}
+
+// storeOf returns the store of a repository name from a request path,
+// "<namespace>/<chart>".
+func (s *server) storeOf(repoName string) *store {
+	if repo, _, ok := s.findRepo(repoName); ok {
+		return s.storeFor(repo.Prefix)
+	}
+	return s.stores[0]
+}
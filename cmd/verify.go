@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/tuananh/helm-oci-proxy/pkg/serve"
+	"helm.sh/helm/v3/pkg/chart"
+)
+
+// runVerify checks the stored content and optionally repairs it by deleting
+// corrupt blobs and rebuilding the affected charts from upstream.
+func runVerify(ctx context.Context, args []string) error {
+	fs, configFile := newFlagSet("verify")
+	repair := fs.Bool("repair", false, "Delete corrupt blobs and rebuild affected charts from upstream")
+	concurrency := fs.Int("concurrency", 8, "Number of blobs hashed in parallel")
+	fs.Parse(args)
+
+	config, err := commandConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	s, err := commandServer(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	found := 0
+	for _, st := range s.stores {
+		problems, err := serve.Verify(ctx, st.storage, serve.VerifyOptions{
+			Repair:      *repair,
+			Concurrency: *concurrency,
+			Rebuild:     s.rebuild,
+		})
+		for _, p := range problems {
+			slog.WarnContext(ctx, "verify: "+p.Kind, "name", p.Name, "detail", p.Detail, "repaired", p.Repaired)
+		}
+		slog.InfoContext(ctx, "verify done", "namespaces", st.namespaces(), "problems", len(problems), "repair", *repair)
+		if err != nil {
+			return err
+		}
+		found += len(problems)
+	}
+	if found > 0 && !*repair {
+		return fmt.Errorf("found %d problems", found)
+	}
+	return nil
+}
+
+// rebuild builds the chart of a tag pointer from upstream again and stores it
+// under the same name.
+func (s *server) rebuild(ctx context.Context, tagName string, md *chart.Metadata) error {
+	if md == nil {
+		return fmt.Errorf("chart of %s is unknown", tagName)
+	}
+	ns, _, ok := strings.Cut(tagName, "/tags/")
+	if !ok {
+		return fmt.Errorf("tag pointer %s has no namespace", tagName)
+	}
+	repo, chartName, ok := s.findRepo(ns + "/" + md.Name)
+	if !ok {
+		return fmt.Errorf("no repository configured for namespace %s", ns)
+	}
+	if upstream, _, _, ok := serve.ParseTagName(tagName); ok && upstream != upstreamKey(repo.URL) {
+		return fmt.Errorf("tag pointer %s is from %s, not %s", tagName, upstream, repo.URL)
+	}
+
+	img, o, err := s.build(ctx, repo, chartName, md.Version)
+	if err != nil {
+		return err
+	}
+	st := s.storeFor(repo.Prefix)
+	if err := s.write(ctx, st, repo.Prefix+"/"+chartName, img, tagName); err != nil {
+		return err
+	}
+	s.index(ctx, st, tagName, o)
+	return nil
+}
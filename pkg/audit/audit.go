@@ -0,0 +1,104 @@
+// Package audit records who pulled which chart, and where cached charts came
+// from.
+package audit
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tuananh/helm-oci-proxy/pkg/types"
+)
+
+// Actions of events.
+const (
+	ActionPull  = "pull"  // a manifest request
+	ActionBuild = "build" // a chart version fetched from upstream and cached
+)
+
+// Cache results of pulls.
+const (
+	CacheHit  = "hit"
+	CacheMiss = "miss"
+)
+
+// Event is an audited action.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+
+	// Subject is the identity of the client, empty if it didn't
+	// authenticate. Client is its address.
+	Subject string `json:"subject,omitempty"`
+	Client  string `json:"client,omitempty"`
+	Method  string `json:"method,omitempty"`
+
+	Namespace string `json:"namespace"`
+	Chart     string `json:"chart"`
+	Version   string `json:"version"`
+	Digest    string `json:"digest,omitempty"` // of the manifest
+
+	Cache        string `json:"cache,omitempty"`
+	Upstream     string `json:"upstream,omitempty"`
+	Verification string `json:"verification,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// Sink receives audit events. Record is called concurrently.
+type Sink interface {
+	Record(ctx context.Context, e Event) error
+}
+
+// SinkFactory creates a sink from its configuration.
+type SinkFactory func(ctx context.Context, config types.AuditConfig) (Sink, error)
+
+var (
+	sinksMu sync.RWMutex
+	sinks   = map[string]SinkFactory{}
+)
+
+// RegisterSink makes a sink available under the given name, which is matched
+// against the audit type in the config. It is meant to be called from init
+// functions and panics if the name is already registered.
+func RegisterSink(name string, factory SinkFactory) {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+
+	if factory == nil {
+		panic("audit: RegisterSink factory is nil")
+	}
+	if _, dup := sinks[name]; dup {
+		panic(fmt.Sprintf("audit: RegisterSink called twice for sink %q", name))
+	}
+	sinks[name] = factory
+}
+
+// Sinks returns the sorted names of the registered sinks.
+func Sinks() []string {
+	sinksMu.RLock()
+	defer sinksMu.RUnlock()
+
+	names := make([]string, 0, len(sinks))
+	for name := range sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewSink creates the sink of the given configuration. The type defaults to
+// "file".
+func NewSink(ctx context.Context, config types.AuditConfig) (Sink, error) {
+	if config.Type == "" {
+		config.Type = "file"
+	}
+	sinksMu.RLock()
+	factory, ok := sinks[config.Type]
+	sinksMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported audit sink: %s (available: %v)", config.Type, Sinks())
+	}
+	return factory(ctx, config)
+}
@@ -0,0 +1,49 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/tuananh/helm-oci-proxy/pkg/types"
+)
+
+func init() {
+	RegisterSink("file", func(ctx context.Context, config types.AuditConfig) (Sink, error) {
+		if config.Path == "" || config.Path == "-" {
+			return NewJSONSink(os.Stdout), nil
+		}
+		f, err := os.OpenFile(config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+		return NewJSONSink(f), nil
+	})
+}
+
+// JSONSink writes events to w as JSON lines.
+type JSONSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONSink returns a sink writing to w.
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{w: w}
+}
+
+// Record writes e as one line, in a single write so that lines of several
+// processes appending to the same file don't interleave.
+func (s *JSONSink) Record(_ context.Context, e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(b, '\n'))
+	return err
+}
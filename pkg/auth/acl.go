@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"fmt"
+	"path"
+	"slices"
+
+	"github.com/tuananh/helm-oci-proxy/pkg/types"
+)
+
+// ACL decides which clients may do what in which namespaces. Anything no rule
+// allows is denied.
+type ACL struct {
+	groups map[string][]string
+	rules  []types.ACLRule
+}
+
+// NewACL returns the ACL of config.
+func NewACL(config types.ACLConfig) (*ACL, error) {
+	for i, rule := range config.Rules {
+		if len(rule.Subjects) == 0 && len(rule.Groups) == 0 {
+			return nil, fmt.Errorf("acl rule %d: subjects or groups are required", i)
+		}
+		if len(rule.Namespaces) == 0 {
+			return nil, fmt.Errorf("acl rule %d: namespaces are required", i)
+		}
+		for _, a := range rule.Actions {
+			if a != "pull" && a != "*" {
+				return nil, fmt.Errorf("acl rule %d: unknown action %q", i, a)
+			}
+		}
+		for _, g := range rule.Namespaces {
+			if _, err := path.Match(g, ""); err != nil {
+				return nil, fmt.Errorf("acl rule %d: %q: %w", i, g, err)
+			}
+		}
+	}
+	return &ACL{groups: config.Groups, rules: config.Rules}, nil
+}
+
+// Allows reports whether id may perform action on the repository name
+// ("<namespace>/<chart>"). Subject globs are matched with matchSubject.
+// Namespace globs match either the namespace or the whole name, so "argo" and
+// "argo/*" are the same.
+func (a *ACL) Allows(id Identity, name, action string) bool {
+	groups := a.groupsOf(id)
+	for _, rule := range a.rules {
+		if !matchAnySubject(rule.Subjects, id.Subject) && !slices.ContainsFunc(rule.Groups, func(g string) bool {
+			return slices.Contains(groups, g)
+		}) {
+			continue
+		}
+		if !matchAny(rule.Namespaces, path.Dir(name)) && !matchAny(rule.Namespaces, name) {
+			continue
+		}
+		actions := rule.Actions
+		if len(actions) == 0 {
+			actions = []string{"pull"}
+		}
+		if slices.Contains(actions, action) || slices.Contains(actions, "*") {
+			return true
+		}
+	}
+	return false
+}
+
+// groupsOf returns the groups of id, those it came with and those the ACL
+// puts its subject in.
+func (a *ACL) groupsOf(id Identity) []string {
+	groups := slices.Clone(id.Groups)
+	for g, members := range a.groups {
+		if matchAnySubject(members, id.Subject) {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// matchAnySubject reports whether subject matches any of the globs, see
+// matchSubject.
+func matchAnySubject(globs []string, subject string) bool {
+	return slices.ContainsFunc(globs, func(g string) bool {
+		return matchSubject(g, subject)
+	})
+}
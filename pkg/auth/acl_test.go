@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/tuananh/helm-oci-proxy/pkg/types"
+)
+
+func TestACLAllows(t *testing.T) {
+	acl, err := NewACL(types.ACLConfig{
+		Groups: map[string][]string{
+			"platform": {"alice", "ci:platform/*"},
+		},
+		Rules: []types.ACLRule{
+			{Subjects: []string{"*"}, Namespaces: []string{"public"}},
+			{Groups: []string{"platform"}, Namespaces: []string{"argo", "internal-*"}},
+			{Subjects: []string{"repo:org/*"}, Namespaces: []string{"team-a/*"}, Actions: []string{"*"}},
+			{Groups: []string{"oidc-admins"}, Namespaces: []string{"*"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewACL: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		id     Identity
+		repo   string
+		action string
+		want   bool
+	}{
+		{"anyone in public", Identity{}, "public/nginx", "pull", true},
+		{"anonymous elsewhere", Identity{}, "argo/argo-cd", "pull", false},
+		{"acl group member", Identity{Subject: "alice"}, "argo/argo-cd", "pull", true},
+		{"acl group glob member", Identity{Subject: "ci:platform/deploy"}, "internal-b/chart", "pull", true},
+		{"acl group other namespace", Identity{Subject: "alice"}, "team-a/chart", "pull", false},
+		{"not a member", Identity{Subject: "bob"}, "argo/argo-cd", "pull", false},
+		{"subject glob across slashes", Identity{Subject: "repo:org/app:ref:refs/heads/main"}, "team-a/chart", "pull", true},
+		{"namespace glob on the whole name", Identity{Subject: "repo:org/app"}, "team-a/chart", "pull", true},
+		{"namespace glob doesn't match other namespaces", Identity{Subject: "repo:org/app"}, "team-b/chart", "pull", false},
+		{"token group", Identity{Subject: "carol", Groups: []string{"oidc-admins"}}, "anything/chart", "pull", true},
+		{"default action is pull only", Identity{Subject: "alice"}, "argo/argo-cd", "push", false},
+		{"wildcard action", Identity{Subject: "repo:org/app"}, "team-a/chart", "push", true},
+	}
+	for _, tt := range tests {
+		if got := acl.Allows(tt.id, tt.repo, tt.action); got != tt.want {
+			t.Errorf("%s: Allows(%+v, %q, %q) = %v, want %v", tt.name, tt.id, tt.repo, tt.action, got, tt.want)
+		}
+	}
+}
+
+func TestNewACLInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		rule types.ACLRule
+	}{
+		{"no subjects or groups", types.ACLRule{Namespaces: []string{"argo"}}},
+		{"no namespaces", types.ACLRule{Subjects: []string{"*"}}},
+		{"unknown action", types.ACLRule{Subjects: []string{"*"}, Namespaces: []string{"argo"}, Actions: []string{"push"}}},
+		{"bad namespace glob", types.ACLRule{Subjects: []string{"*"}, Namespaces: []string{"argo["}}},
+	}
+	for _, tt := range tests {
+		if _, err := NewACL(types.ACLConfig{Rules: []types.ACLRule{tt.rule}}); err == nil {
+			t.Errorf("%s: NewACL succeeded, want an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Package auth authenticates clients of the registry API.
+package auth
+
+import (
+	"context"
+	"path"
+	"slices"
+	"strings"
+)
+
+// DefaultRealm is the realm of the Basic challenge when none is configured.
+const DefaultRealm = "helm-oci-proxy"
+
+// Identity is an authenticated client.
+type Identity struct {
+	Subject string
+	Groups  []string
+
+	// Namespaces, if not nil, limits the identity to pulling from the
+	// namespaces matching these globs.
+	Namespaces []string
+
+	// Access lists what a bearer token grants. It is nil for identities
+	// that are not limited to scopes, such as Basic auth users.
+	Access []Access
+}
+
+// Allows reports whether id may perform action on the resource of scope.
+func (id Identity) Allows(s Scope) bool {
+	if s.Type == "repository" && !id.InNamespaces(s.Name) {
+		return false
+	}
+	if id.Access == nil {
+		return true
+	}
+	for _, a := range id.Access {
+		if a.Type != s.Type || a.Name != s.Name {
+			continue
+		}
+		for _, want := range s.Actions {
+			if !slices.Contains(a.Actions, want) && !slices.Contains(a.Actions, "*") {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// InNamespaces reports whether the repository name is in the namespaces of
+// id, if it is limited to some.
+func (id Identity) InNamespaces(name string) bool {
+	return id.Namespaces == nil || matchAny(id.Namespaces, path.Dir(name))
+}
+
+// matchAny reports whether name matches any of the globs.
+func matchAny(globs []string, name string) bool {
+	for _, g := range globs {
+		if ok, _ := path.Match(g, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSubject reports whether s matches glob, in which "*" matches any run
+// of characters and "?" any single one. Unlike with path.Match, "*" also
+// matches "/": subjects and claims such as "repo:org/app:ref:refs/heads/main"
+// are not paths.
+func matchSubject(glob, s string) bool {
+	g, t := []rune(glob), []rune(s)
+	gi, ti := 0, 0
+	star, mark := -1, 0 // position of the last "*", and where its match ends
+	for ti < len(t) {
+		switch {
+		case gi < len(g) && (g[gi] == '?' || g[gi] == t[ti]):
+			gi++
+			ti++
+		case gi < len(g) && g[gi] == '*':
+			star, mark = gi, ti
+			gi++
+		case star >= 0:
+			// Let the last "*" take one more character.
+			mark++
+			gi, ti = star+1, mark
+		default:
+			return false
+		}
+	}
+	for gi < len(g) && g[gi] == '*' {
+		gi++
+	}
+	return gi == len(g)
+}
+
+// Source authenticates clients by user name and password.
+type Source interface {
+	Authenticate(username, password string) (Identity, bool)
+}
+
+// Verifier authenticates clients by a bearer token. It returns an error if
+// the token is not one it accepts.
+type Verifier interface {
+	Verify(ctx context.Context, token string) (Identity, error)
+}
+
+// Access is a resource and the actions granted on it, as in the access claim
+// of registry tokens.
+type Access struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+// Scope is a resource and the actions requested on it, written
+// "<type>:<name>:<action>[,<action>]", e.g. "repository:argo/argo-cd:pull".
+type Scope Access
+
+// ParseScope parses a scope string.
+func ParseScope(s string) (Scope, bool) {
+	typ, rest, ok := strings.Cut(s, ":")
+	if !ok {
+		return Scope{}, false
+	}
+	// Names may contain a port-like ":", actions never do.
+	i := strings.LastIndex(rest, ":")
+	if i < 0 || typ == "" || rest[:i] == "" || rest[i+1:] == "" {
+		return Scope{}, false
+	}
+	return Scope{Type: typ, Name: rest[:i], Actions: strings.Split(rest[i+1:], ",")}, true
+}
+
+func (s Scope) String() string {
+	return s.Type + ":" + s.Name + ":" + strings.Join(s.Actions, ",")
+}
+
+// RequestScope returns the scope needed for a request to the registry API,
+// or false for the /v2/ version check, which only needs a client to be
+// authenticated.
+func RequestScope(path string) (Scope, bool) {
+	rest := strings.Trim(strings.TrimPrefix(path, "/v2/"), "/")
+	if rest == "" {
+		return Scope{}, false
+	}
+	if rest == "_catalog" {
+		return Scope{Type: "registry", Name: "catalog", Actions: []string{"*"}}, true
+	}
+	parts := strings.Split(rest, "/")
+	for i := len(parts) - 2; i > 0; i-- {
+		switch parts[i] {
+		case "manifests", "blobs", "tags":
+			return Scope{Type: "repository", Name: strings.Join(parts[:i], "/"), Actions: []string{"pull"}}, true
+		}
+	}
+	return Scope{Type: "repository", Name: rest, Actions: []string{"pull"}}, true
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of ctx carrying id.
+func WithIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns the identity of the client of a request, if it
+// authenticated.
+func FromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
@@ -0,0 +1,67 @@
+package auth
+
+import "testing"
+
+func TestMatchSubject(t *testing.T) {
+	tests := []struct {
+		glob, s string
+		want    bool
+	}{
+		{"alice", "alice", true},
+		{"alice", "alice2", false},
+		{"alice", "", false},
+		{"", "", true},
+		{"*", "", true},
+		{"*", "anything/at:all", true},
+		{"ci-*", "ci-deploy", true},
+		{"ci-*", "ci-", true},
+		{"ci-*", "deploy-ci", false},
+		{"repo:org/*", "repo:org/app:ref:refs/heads/main", true},
+		{"repo:org/*", "repo:other/app:ref:refs/heads/main", false},
+		{"repo:org/*:ref:refs/heads/main", "repo:org/app:ref:refs/heads/main", true},
+		{"repo:org/*:ref:refs/heads/main", "repo:org/app:ref:refs/heads/dev", false},
+		{"repo:*/app:*", "repo:org/app:ref:refs/tags/v1", true},
+		{"*main", "refs/heads/main", true},
+		{"*a*b*", "xaxxbx", true},
+		{"*a*b*", "xbxxax", false},
+		{"user?", "user1", true},
+		{"user?", "user", false},
+		{"user?", "user12", false},
+		{"u?er", "u/er", true},
+		{"[ab]", "a", false},
+		{"**", "a/b", true},
+		{"ünï*", "ünïcode", true},
+	}
+	for _, tt := range tests {
+		if got := matchSubject(tt.glob, tt.s); got != tt.want {
+			t.Errorf("matchSubject(%q, %q) = %v, want %v", tt.glob, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestIdentityAllows(t *testing.T) {
+	pull := Scope{Type: "repository", Name: "argo/argo-cd", Actions: []string{"pull"}}
+	tests := []struct {
+		name string
+		id   Identity
+		s    Scope
+		want bool
+	}{
+		{"unlimited", Identity{Subject: "alice"}, pull, true},
+		{"in namespace", Identity{Namespaces: []string{"argo"}}, pull, true},
+		{"namespace glob", Identity{Namespaces: []string{"ar*"}}, pull, true},
+		{"other namespace", Identity{Namespaces: []string{"team-a"}}, pull, false},
+		{"no namespaces", Identity{Namespaces: []string{}}, pull, false},
+		{"catalog ignores namespaces", Identity{Namespaces: []string{}}, Scope{Type: "registry", Name: "catalog", Actions: []string{"*"}}, true},
+		{"granted", Identity{Access: []Access{{Type: "repository", Name: "argo/argo-cd", Actions: []string{"pull"}}}}, pull, true},
+		{"granted wildcard", Identity{Access: []Access{{Type: "repository", Name: "argo/argo-cd", Actions: []string{"*"}}}}, pull, true},
+		{"other repository", Identity{Access: []Access{{Type: "repository", Name: "argo/other", Actions: []string{"pull"}}}}, pull, false},
+		{"other action", Identity{Access: []Access{{Type: "repository", Name: "argo/argo-cd", Actions: []string{"push"}}}}, pull, false},
+		{"nothing granted", Identity{Access: []Access{}}, pull, false},
+	}
+	for _, tt := range tests {
+		if got := tt.id.Allows(tt.s); got != tt.want {
+			t.Errorf("%s: Allows(%v) = %v, want %v", tt.name, tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against when a user is unknown, so that unknown and
+// known users take as long to reject.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("helm-oci-proxy"), bcrypt.DefaultCost)
+
+// Htpasswd authenticates users against an htpasswd file of bcrypt hashes, as
+// written by `htpasswd -B`. The file is read again when it changes, so that
+// users can be added or removed without a restart.
+type Htpasswd struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	users   map[string][]byte
+}
+
+// NewHtpasswd loads the htpasswd file at path.
+func NewHtpasswd(path string) (*Htpasswd, error) {
+	h := &Htpasswd{path: path}
+	if err := h.reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Authenticate checks that password is that of username.
+func (h *Htpasswd) Authenticate(username, password string) (Identity, bool) {
+	h.mu.Lock()
+	if err := h.reload(); err != nil {
+		// Keep the users we have rather than locking everyone out
+		// while the file is being replaced.
+		slog.Warn("failed to reload htpasswd file, keeping the previous users", "path", h.path, "err", err)
+	}
+	hash, ok := h.users[username]
+	h.mu.Unlock()
+
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return Identity{}, false
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return Identity{}, false
+	}
+	return Identity{Subject: username}, true
+}
+
+// reload reads the file again if it changed since it was last read. h.mu
+// must be held, or h not shared yet.
+func (h *Htpasswd) reload() error {
+	fi, err := os.Stat(h.path)
+	if err != nil {
+		return err
+	}
+	if h.users != nil && fi.ModTime().Equal(h.modTime) && fi.Size() == h.size {
+		return nil
+	}
+	b, err := os.ReadFile(h.path)
+	if err != nil {
+		return err
+	}
+	users, err := parseHtpasswd(b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", h.path, err)
+	}
+	h.users, h.modTime, h.size = users, fi.ModTime(), fi.Size()
+	return nil
+}
+
+func parseHtpasswd(b []byte) (map[string][]byte, error) {
+	users := map[string][]byte{}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: expected user:hash", n)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("line %d: user %s: only bcrypt hashes are supported (htpasswd -B)", n, user)
+		}
+		users[user] = []byte(hash)
+	}
+	return users, s.Err()
+}
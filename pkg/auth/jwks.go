@@ -0,0 +1,226 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksRefresh is how often a fetched key set is fetched again.
+	jwksRefresh = time.Hour
+	// jwksMinRefresh is how soon a token signed with an unknown key may
+	// make the key set be fetched again, for keys rotated in early.
+	jwksMinRefresh = 30 * time.Second
+)
+
+var jwksClient = &http.Client{Timeout: 10 * time.Second}
+
+// keySet is the JSON Web Key Set of an issuer. Remote sets are fetched from
+// url, or the URL the issuer's discovery document gives if it is empty.
+type keySet struct {
+	issuer string
+	url    string
+	remote bool
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey // by key ID
+	fetched time.Time
+}
+
+// key returns the key kid, or all keys if kid is empty.
+func (ks *keySet) key(ctx context.Context, kid string) ([]crypto.PublicKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	_, known := ks.keys[kid]
+	if ks.remote && (time.Since(ks.fetched) > jwksRefresh || !known && kid != "" && time.Since(ks.fetched) > jwksMinRefresh) {
+		if err := ks.fetch(ctx); err != nil {
+			if ks.keys == nil {
+				return nil, err
+			}
+			slog.WarnContext(ctx, "failed to refresh JWKS, keeping the previous keys", "issuer", ks.issuer, "err", err)
+		}
+	}
+
+	if kid == "" {
+		keys := make([]crypto.PublicKey, 0, len(ks.keys))
+		for _, k := range ks.keys {
+			keys = append(keys, k)
+		}
+		return keys, nil
+	}
+	k, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return []crypto.PublicKey{k}, nil
+}
+
+// fetch fetches the key set, discovering its URL first if needed. ks.mu must
+// be held.
+func (ks *keySet) fetch(ctx context.Context) error {
+	// Don't retry a failing issuer on every request.
+	ks.fetched = time.Now()
+	if ks.url == "" {
+		var doc struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := getJSON(ctx, strings.TrimSuffix(ks.issuer, "/")+"/.well-known/openid-configuration", &doc); err != nil {
+			return err
+		}
+		if doc.JWKSURI == "" {
+			return fmt.Errorf("discovery document of %s has no jwks_uri", ks.issuer)
+		}
+		ks.url = doc.JWKSURI
+	}
+	var raw json.RawMessage
+	if err := getJSON(ctx, ks.url, &raw); err != nil {
+		return err
+	}
+	keys, err := parseJWKS(raw)
+	if err != nil {
+		return fmt.Errorf("%s: %w", ks.url, err)
+	}
+	ks.keys = keys
+	return nil
+}
+
+func getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := jwksClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v); err != nil {
+		return fmt.Errorf("GET %s: %w", url, err)
+	}
+	return nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS parses the signing keys of a JSON Web Key Set. Keys of unknown
+// types are skipped.
+func parseJWKS(b []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if errors.Is(err, errors.ErrUnsupported) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = pub
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("curve %s: %w", k.Crv, errors.ErrUnsupported)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("curve %s: %w", k.Crv, errors.ErrUnsupported)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("key type %s: %w", k.Kty, errors.ErrUnsupported)
+	}
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
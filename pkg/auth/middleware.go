@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/tuananh/helm-oci-proxy/pkg/serve"
+)
+
+// Middleware requires requests to the registry API to be authenticated, with
+// Basic credentials checked against Sources or bearer tokens checked against
+// Verifiers. Unauthenticated requests, the /v2/ version check included, get a
+// 401 with a challenge so that clients prompt for, or send, credentials.
+type Middleware struct {
+	Sources   []Source
+	Verifiers []Verifier
+
+	// Realm is the realm of the Basic challenge.
+	Realm string
+
+	// Tokens, if set, makes the challenge send clients to its token
+	// endpoint instead of asking for Basic credentials.
+	Tokens *TokenService
+}
+
+// Wrap returns next with authentication in front of it.
+func (m *Middleware) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := m.authenticate(r)
+		if !ok {
+			m.challenge(w, r, "")
+			return
+		}
+		if scope, ok := RequestScope(r.URL.Path); ok && !id.Allows(scope) {
+			m.challenge(w, r, scope.String())
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), id)))
+	})
+}
+
+func (m *Middleware) authenticate(r *http.Request) (Identity, bool) {
+	if username, password, ok := r.BasicAuth(); ok {
+		return authenticate(m.Sources, username, password)
+	}
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return Identity{}, false
+	}
+	for _, v := range m.Verifiers {
+		if id, err := v.Verify(r.Context(), token); err == nil {
+			return id, true
+		}
+	}
+	return Identity{}, false
+}
+
+// challenge rejects a request. scope is the scope the client lacks, if it
+// authenticated. With a token service, that is another 401, so that the
+// client fetches a token for it.
+func (m *Middleware) challenge(w http.ResponseWriter, r *http.Request, scope string) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if m.Tokens != nil {
+		c := fmt.Sprintf("Bearer realm=%q,service=%q", m.Tokens.Realm, m.Tokens.Service)
+		if s, ok := RequestScope(r.URL.Path); ok {
+			c += fmt.Sprintf(",scope=%q", s.String())
+		}
+		if scope != "" {
+			c += `,error="insufficient_scope"`
+		}
+		w.Header().Set("WWW-Authenticate", c)
+		serve.Error(w, serve.ErrUnauthorized)
+		return
+	}
+	if scope != "" {
+		serve.Error(w, serve.ErrDenied)
+		return
+	}
+	realm := m.Realm
+	if realm == "" {
+		realm = DefaultRealm
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+	serve.Error(w, serve.ErrUnauthorized)
+}
+
+// authenticate checks username and password against each of sources.
+func authenticate(sources []Source, username, password string) (Identity, bool) {
+	for _, s := range sources {
+		if id, ok := s.Authenticate(username, password); ok {
+			return id, true
+		}
+	}
+	return Identity{}, false
+}
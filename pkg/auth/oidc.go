@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/tuananh/helm-oci-proxy/pkg/types"
+)
+
+// oidcMethods are the signing algorithms accepted from issuers.
+var oidcMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// OIDC authenticates clients by JWTs of an OpenID Connect issuer, such as the
+// workload identity tokens of CI systems, checked against the issuer's JSON
+// Web Key Set. The claims of a token give it namespaces through rules.
+type OIDC struct {
+	issuer       string
+	audiences    []string
+	subjectClaim string
+	groupsClaim  string
+	rules        []types.ClaimRule
+	keys         *keySet
+}
+
+// NewOIDC returns the verifier of the tokens of an issuer. Remote key sets are
+// fetched on first use.
+func NewOIDC(config types.OIDCConfig) (*OIDC, error) {
+	if config.Issuer == "" {
+		return nil, errors.New("oidc: issuer is required")
+	}
+	if len(config.Audiences) == 0 {
+		return nil, fmt.Errorf("oidc %s: audiences are required", config.Issuer)
+	}
+	o := &OIDC{
+		issuer:       config.Issuer,
+		audiences:    config.Audiences,
+		subjectClaim: config.SubjectClaim,
+		groupsClaim:  config.GroupsClaim,
+		rules:        config.Rules,
+		keys:         &keySet{issuer: config.Issuer, url: config.JWKSURL, remote: true},
+	}
+	if o.subjectClaim == "" {
+		o.subjectClaim = "sub"
+	}
+	if o.groupsClaim == "" {
+		o.groupsClaim = "groups"
+	}
+	if config.JWKSFile != "" {
+		b, err := os.ReadFile(config.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("oidc %s: %w", config.Issuer, err)
+		}
+		keys, err := parseJWKS(b)
+		if err != nil {
+			return nil, fmt.Errorf("oidc %s: %s: %w", config.Issuer, config.JWKSFile, err)
+		}
+		o.keys = &keySet{issuer: config.Issuer, keys: keys}
+	}
+	return o, nil
+}
+
+// Verify checks a token of the issuer and returns its identity, limited to
+// the namespaces its claims are given.
+func (o *OIDC) Verify(ctx context.Context, token string) (Identity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		// Several issuers may be configured; don't fetch keys for
+		// tokens of the others.
+		if iss, _ := claims.GetIssuer(); iss != o.issuer {
+			return nil, fmt.Errorf("token issued by %q", iss)
+		}
+		kid, _ := t.Header["kid"].(string)
+		keys, err := o.keys.key(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		set := jwt.VerificationKeySet{}
+		for _, k := range keys {
+			set.Keys = append(set.Keys, k)
+		}
+		return set, nil
+	},
+		jwt.WithValidMethods(oidcMethods),
+		jwt.WithIssuer(o.issuer),
+		jwt.WithAudience(o.audiences...),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30*time.Second),
+	)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	subject, _ := claims[o.subjectClaim].(string)
+	if subject == "" {
+		return Identity{}, fmt.Errorf("token has no %s claim", o.subjectClaim)
+	}
+	id := Identity{Subject: subject, Namespaces: []string{}}
+	switch groups := claims[o.groupsClaim].(type) {
+	case string:
+		id.Groups = []string{groups}
+	case []any:
+		for _, g := range groups {
+			if g, ok := g.(string); ok {
+				id.Groups = append(id.Groups, g)
+			}
+		}
+	}
+	for _, rule := range o.rules {
+		if matchClaims(rule.Claims, claims) {
+			id.Namespaces = append(id.Namespaces, rule.Namespaces...)
+		}
+	}
+	return id, nil
+}
+
+// Authenticate accepts a token of the issuer as the password, for clients
+// that only do Basic auth, such as `helm registry login`.
+func (o *OIDC) Authenticate(_, password string) (Identity, bool) {
+	if strings.Count(password, ".") != 2 {
+		return Identity{}, false
+	}
+	id, err := o.Verify(context.Background(), password)
+	return id, err == nil
+}
+
+// matchClaims reports whether every claim of want matches its glob, see
+// matchSubject. List claims, such as groups, match if any of their elements
+// does.
+func matchClaims(want map[string]string, claims jwt.MapClaims) bool {
+	for name, glob := range want {
+		var values []any
+		switch v := claims[name].(type) {
+		case nil:
+			return false
+		case []any:
+			values = v
+		default:
+			values = []any{v}
+		}
+		matched := false
+		for _, v := range values {
+			if matchSubject(glob, fmt.Sprint(v)) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,244 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/tuananh/helm-oci-proxy/pkg/serve"
+)
+
+// DefaultTokenTTL is how long issued tokens are valid when no TTL is configured.
+const DefaultTokenTTL = 5 * time.Minute
+
+// TokenService is the token endpoint of the distribution token auth flow.
+// Clients authenticate to it with Basic credentials checked against Sources
+// and get a short-lived signed token granting the scopes they asked for,
+// which it then verifies on registry requests.
+type TokenService struct {
+	Service string // Audience of the tokens, sent to clients in the challenge
+	Issuer  string
+	TTL     time.Duration
+	Sources []Source
+
+	// ACL, if set, limits the scopes granted.
+	ACL *ACL
+
+	// Realm is the URL of the token endpoint sent to clients. It must be
+	// configured: built from the Host header of requests, it would let a
+	// spoofed header send clients' credentials elsewhere.
+	Realm string
+
+	key    crypto.Signer
+	method jwt.SigningMethod
+}
+
+// NewTokenService returns a token service signing with key, which must be an
+// RSA, ECDSA or Ed25519 key.
+func NewTokenService(key crypto.Signer, sources []Source) (*TokenService, error) {
+	var method jwt.SigningMethod
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		method = jwt.SigningMethodRS256
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			method = jwt.SigningMethodES256
+		case elliptic.P384():
+			method = jwt.SigningMethodES384
+		case elliptic.P521():
+			method = jwt.SigningMethodES512
+		default:
+			return nil, fmt.Errorf("unsupported ECDSA curve %s", k.Curve.Params().Name)
+		}
+	case ed25519.PrivateKey:
+		method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", key)
+	}
+	return &TokenService{
+		Service: DefaultRealm,
+		Issuer:  DefaultRealm,
+		TTL:     DefaultTokenTTL,
+		Sources: sources,
+		key:     key,
+		method:  method,
+	}, nil
+}
+
+// LoadSigningKey reads a PEM-encoded private key.
+func LoadSigningKey(path string) (crypto.Signer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported key type %T", path, key)
+	}
+	return signer, nil
+}
+
+// GenerateSigningKey returns a new ECDSA P-256 key, for when none is
+// configured. Tokens signed with it are only valid on this process.
+func GenerateSigningKey() (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+type tokenClaims struct {
+	jwt.RegisteredClaims
+	Groups []string `json:"groups,omitempty"`
+	// Namespaces is null for identities that aren't limited to some, so
+	// it is kept even when empty.
+	Namespaces []string `json:"namespaces"`
+	Access     []Access `json:"access"`
+}
+
+// ServeHTTP issues a token to a client authenticated with Basic credentials,
+// granting the scope query parameters it may have.
+func (ts *TokenService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", ts.Service))
+		serve.Error(w, serve.ErrUnauthorized)
+		return
+	}
+	id, ok := authenticate(ts.Sources, username, password)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", ts.Service))
+		serve.Error(w, serve.ErrUnauthorized)
+		return
+	}
+
+	access := []Access{}
+	for _, param := range r.URL.Query()["scope"] {
+		for _, s := range strings.Fields(param) {
+			scope, ok := ParseScope(s)
+			if !ok {
+				continue
+			}
+			if a, ok := ts.grant(id, scope); ok {
+				access = append(access, a)
+			}
+		}
+	}
+
+	now := time.Now()
+	token, err := ts.issue(id, access, now)
+	if err != nil {
+		serve.Error(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		IssuedAt    string `json:"issued_at"`
+	}{token, token, int(ts.TTL.Seconds()), now.UTC().Format(time.RFC3339)})
+}
+
+// grant returns the part of scope that id is given. The proxy is read-only,
+// so only pulls and the catalog are ever granted; the catalog is filtered
+// when it is served.
+func (ts *TokenService) grant(id Identity, s Scope) (Access, bool) {
+	if !id.Allows(s) {
+		return Access{}, false
+	}
+	if ts.ACL != nil && s.Type == "repository" && !ts.ACL.Allows(id, s.Name, "pull") {
+		return Access{}, false
+	}
+	var allowed string
+	switch {
+	case s.Type == "repository":
+		allowed = "pull"
+	case s.Type == "registry" && s.Name == "catalog":
+		allowed = "*"
+	default:
+		return Access{}, false
+	}
+	for _, a := range s.Actions {
+		if a == allowed {
+			return Access{Type: s.Type, Name: s.Name, Actions: []string{allowed}}, true
+		}
+	}
+	return Access{}, false
+}
+
+func (ts *TokenService) issue(id Identity, access []Access, now time.Time) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	claims := tokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    ts.Issuer,
+			Subject:   id.Subject,
+			Audience:  jwt.ClaimStrings{ts.Service},
+			ExpiresAt: jwt.NewNumericDate(now.Add(ts.TTL)),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        hex.EncodeToString(jti),
+		},
+		Groups:     id.Groups,
+		Namespaces: id.Namespaces,
+		Access:     access,
+	}
+	return jwt.NewWithClaims(ts.method, claims).SignedString(ts.key)
+}
+
+// Verify checks a token issued by ts and returns the identity it was issued
+// to, limited to the access it grants.
+func (ts *TokenService) Verify(_ context.Context, token string) (Identity, error) {
+	var claims tokenClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (any, error) {
+		return ts.key.Public(), nil
+	},
+		jwt.WithValidMethods([]string{ts.method.Alg()}),
+		jwt.WithIssuer(ts.Issuer),
+		jwt.WithAudience(ts.Service),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return Identity{}, err
+	}
+	if claims.Access == nil {
+		claims.Access = []Access{}
+	}
+	if claims.Subject == "" {
+		return Identity{}, errors.New("token has no subject")
+	}
+	return Identity{Subject: claims.Subject, Groups: claims.Groups, Namespaces: claims.Namespaces, Access: claims.Access}, nil
+}
@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tuananh/helm-oci-proxy/pkg/types"
+)
+
+func newTestTokenService(t *testing.T) *TokenService {
+	t.Helper()
+	key, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatalf("GenerateSigningKey: %v", err)
+	}
+	ts, err := NewTokenService(key, nil)
+	if err != nil {
+		t.Fatalf("NewTokenService: %v", err)
+	}
+	return ts
+}
+
+func TestTokenGrant(t *testing.T) {
+	ts := newTestTokenService(t)
+	acl, err := NewACL(types.ACLConfig{Rules: []types.ACLRule{
+		{Subjects: []string{"alice"}, Namespaces: []string{"argo"}},
+	}})
+	if err != nil {
+		t.Fatalf("NewACL: %v", err)
+	}
+
+	alice := Identity{Subject: "alice"}
+	tests := []struct {
+		name  string
+		acl   *ACL
+		id    Identity
+		scope string
+		want  *Access
+	}{
+		{"pull", nil, alice, "repository:argo/argo-cd:pull", &Access{"repository", "argo/argo-cd", []string{"pull"}}},
+		{"pull among other actions", nil, alice, "repository:argo/argo-cd:push,pull", &Access{"repository", "argo/argo-cd", []string{"pull"}}},
+		{"push only", nil, alice, "repository:argo/argo-cd:push", nil},
+		{"wildcard on a repository", nil, alice, "repository:argo/argo-cd:*", nil},
+		{"catalog", nil, alice, "registry:catalog:*", &Access{"registry", "catalog", []string{"*"}}},
+		{"other registry resource", nil, alice, "registry:other:*", nil},
+		{"unknown type", nil, alice, "plugin:argo/argo-cd:pull", nil},
+		{"acl allows", acl, alice, "repository:argo/argo-cd:pull", &Access{"repository", "argo/argo-cd", []string{"pull"}}},
+		{"acl denies", acl, alice, "repository:team-a/chart:pull", nil},
+		{"acl doesn't limit the catalog", acl, Identity{Subject: "bob"}, "registry:catalog:*", &Access{"registry", "catalog", []string{"*"}}},
+		{"outside the identity's namespaces", nil, Identity{Subject: "ci", Namespaces: []string{"team-a"}}, "repository:argo/argo-cd:pull", nil},
+		{"in the identity's namespaces", nil, Identity{Subject: "ci", Namespaces: []string{"team-*"}}, "repository:team-a/chart:pull", &Access{"repository", "team-a/chart", []string{"pull"}}},
+	}
+	for _, tt := range tests {
+		ts.ACL = tt.acl
+		scope, ok := ParseScope(tt.scope)
+		if !ok {
+			t.Fatalf("%s: ParseScope(%q) failed", tt.name, tt.scope)
+		}
+		got, ok := ts.grant(tt.id, scope)
+		switch {
+		case tt.want == nil && ok:
+			t.Errorf("%s: grant(%s) = %+v, want nothing", tt.name, tt.scope, got)
+		case tt.want != nil && !ok:
+			t.Errorf("%s: grant(%s) = nothing, want %+v", tt.name, tt.scope, *tt.want)
+		case tt.want != nil && !reflect.DeepEqual(got, *tt.want):
+			t.Errorf("%s: grant(%s) = %+v, want %+v", tt.name, tt.scope, got, *tt.want)
+		}
+	}
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	ts := newTestTokenService(t)
+	access := []Access{{Type: "repository", Name: "argo/argo-cd", Actions: []string{"pull"}}}
+	tests := []struct {
+		name string
+		id   Identity
+	}{
+		{"unlimited", Identity{Subject: "alice", Groups: []string{"platform"}}},
+		{"no namespaces", Identity{Subject: "ci", Namespaces: []string{}}},
+		{"some namespaces", Identity{Subject: "ci", Namespaces: []string{"team-a"}}},
+	}
+	for _, tt := range tests {
+		token, err := ts.issue(tt.id, access, time.Now())
+		if err != nil {
+			t.Fatalf("%s: issue: %v", tt.name, err)
+		}
+		got, err := ts.Verify(context.Background(), token)
+		if err != nil {
+			t.Fatalf("%s: Verify: %v", tt.name, err)
+		}
+		want := tt.id
+		want.Access = access
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Verify = %+v, want %+v", tt.name, got, want)
+		}
+	}
+}
+
+func TestTokenVerifyRejects(t *testing.T) {
+	ts := newTestTokenService(t)
+	id := Identity{Subject: "alice"}
+
+	expired, err := ts.issue(id, nil, time.Now().Add(-2*ts.TTL))
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	other := newTestTokenService(t)
+	foreign, err := other.issue(id, nil, time.Now())
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	ts.Service = "another-service"
+	audience, err := ts.issue(id, nil, time.Now())
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	ts.Service = DefaultRealm
+
+	tests := []struct {
+		name, token string
+	}{
+		{"expired", expired},
+		{"signed by another key", foreign},
+		{"for another service", audience},
+		{"garbage", "not-a-token"},
+	}
+	for _, tt := range tests {
+		if _, err := ts.Verify(context.Background(), tt.token); err == nil {
+			t.Errorf("%s: Verify succeeded, want an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// Package certs serves TLS with certificates that are read again from disk
+// when they change, so that rotated certificates are picked up without a
+// restart.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tuananh/helm-oci-proxy/pkg/types"
+)
+
+// Config returns a TLS config for the given options. The certificate, and
+// the client CAs if any, are reloaded on handshakes after their files change.
+func Config(config types.TLSConfig) (*tls.Config, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("tls: certFile and keyFile are required")
+	}
+	minVersion, err := parseVersion(config.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	kp, err := NewKeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	base := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: kp.GetCertificate,
+	}
+	if config.ClientCAFile == "" {
+		if config.ClientAuth != "" {
+			return nil, errors.New("tls: clientAuth requires clientCAFile")
+		}
+		return base, nil
+	}
+
+	switch config.ClientAuth {
+	case "", "require":
+		base.ClientAuth = tls.RequireAndVerifyClientCert
+	case "verify-if-given":
+		base.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("tls: unknown clientAuth %q (want require or verify-if-given)", config.ClientAuth)
+	}
+	cas, err := NewCAPool(config.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	// The config returned for each client replaces the server's, so it
+	// must offer HTTP/2 itself.
+	base.NextProtos = []string{"h2", "http/1.1"}
+	return &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: kp.GetCertificate,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c := base.Clone()
+			c.ClientCAs = cas.Pool()
+			return c, nil
+		},
+	}, nil
+}
+
+func parseVersion(v string) (uint16, error) {
+	switch v {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("tls: unsupported minVersion %q (want 1.2 or 1.3)", v)
+}
+
+// file tracks whether a file changed since it was last read.
+type file struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+func (f *file) changed() (os.FileInfo, bool, error) {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return nil, false, err
+	}
+	return fi, !fi.ModTime().Equal(f.modTime) || fi.Size() != f.size, nil
+}
+
+func (f *file) update(fi os.FileInfo) {
+	f.modTime, f.size = fi.ModTime(), fi.Size()
+}
+
+// KeyPair is a certificate and its key, read again when either file changes.
+type KeyPair struct {
+	mu        sync.Mutex
+	cert, key file
+	pair      *tls.Certificate
+}
+
+// NewKeyPair loads the PEM certificate chain at certFile and its key at
+// keyFile.
+func NewKeyPair(certFile, keyFile string) (*KeyPair, error) {
+	kp := &KeyPair{cert: file{path: certFile}, key: file{path: keyFile}}
+	if err := kp.reload(); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config.
+func (kp *KeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	if err := kp.reload(); err != nil {
+		// Certificate and key are not replaced at once, so the pair may be
+		// mismatched for a moment: keep serving the previous one.
+		slog.Warn("failed to reload TLS certificate, keeping the previous one", "cert", kp.cert.path, "err", err)
+	}
+	return kp.pair, nil
+}
+
+// reload reads the files again if either changed since they were last read.
+// kp.mu must be held, or kp not shared yet.
+func (kp *KeyPair) reload() error {
+	cfi, certChanged, err := kp.cert.changed()
+	if err != nil {
+		return err
+	}
+	kfi, keyChanged, err := kp.key.changed()
+	if err != nil {
+		return err
+	}
+	if kp.pair != nil && !certChanged && !keyChanged {
+		return nil
+	}
+	pair, err := tls.LoadX509KeyPair(kp.cert.path, kp.key.path)
+	if err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	if kp.pair != nil {
+		slog.Info("reloaded TLS certificate", "cert", kp.cert.path)
+	}
+	kp.pair = &pair
+	kp.cert.update(cfi)
+	kp.key.update(kfi)
+	return nil
+}
+
+// CAPool is a pool of CA certificates, read again when its file changes.
+type CAPool struct {
+	mu   sync.Mutex
+	file file
+	pool *x509.CertPool
+}
+
+// NewCAPool loads the PEM CA certificates at path.
+func NewCAPool(path string) (*CAPool, error) {
+	p := &CAPool{file: file{path: path}}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Pool returns the current pool.
+func (p *CAPool) Pool() *x509.CertPool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.reload(); err != nil {
+		slog.Warn("failed to reload client CAs, keeping the previous ones", "path", p.file.path, "err", err)
+	}
+	return p.pool
+}
+
+// reload reads the file again if it changed since it was last read. p.mu
+// must be held, or p not shared yet.
+func (p *CAPool) reload() error {
+	fi, changed, err := p.file.changed()
+	if err != nil {
+		return err
+	}
+	if p.pool != nil && !changed {
+		return nil
+	}
+	b, err := os.ReadFile(p.file.path)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return fmt.Errorf("tls: no certificates found in %s", p.file.path)
+	}
+	p.pool = pool
+	p.file.update(fi)
+	return nil
+}
@@ -1,10 +1,15 @@
 package helm
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -17,18 +22,118 @@ type ChartEntry struct {
 	Name    string   `yaml:"name"`
 	Version string   `yaml:"version"`
 	URLs    []string `yaml:"urls"`
+	Digest  string   `yaml:"digest"` // sha256 of the chart archive, hex encoded
+}
+
+// Results of checking a chart archive against the digest listed for it in
+// the repository index.
+const (
+	Verified   = "verified"
+	Unverified = "unverified" // the index lists no digest
+	Mismatch   = "mismatch"
+)
+
+// ErrDigestMismatch is returned for chart archives that don't match the digest
+// in the repository index.
+var ErrDigestMismatch = errors.New("chart does not match the digest in the repository index")
+
+// ErrNotFound is returned for charts and versions the repository index
+// doesn't list.
+var ErrNotFound = errors.New("not found in index")
+
+// Client downloads charts from a repository, within an outbound policy.
+type Client struct {
+	repoURL   string
+	repoHost  string
+	policy    Policy
+	http      *http.Client
+	transport *http.Transport
+}
+
+// NewClient returns a client of the repository at repoURL.
+func NewClient(repoURL string, policy Policy) (*Client, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository URL %q: %w", repoURL, err)
+	}
+	c := &Client{repoURL: strings.TrimSuffix(repoURL, "/"), repoHost: u.Hostname(), policy: policy}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	c.transport = transport
+	if !policy.AllowPrivateNetworks {
+		d := &policyDialer{
+			dialer:  &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+			trusted: map[string]bool{c.repoHost: true},
+		}
+		for _, h := range environmentProxies() {
+			d.trusted[h] = true
+		}
+		transport.DialContext = d.DialContext
+	}
+	c.http = &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > policy.maxRedirects() {
+				return fmt.Errorf("%w: %s: more than %d redirects", ErrBlocked, via[0].URL.Redacted(), policy.maxRedirects())
+			}
+			if err := policy.checkURL(req.URL, c.repoHost); err != nil {
+				return err
+			}
+			return c.checkProxied(req)
+		},
+	}
+	return c, nil
 }
 
 // DownloadChart downloads a Helm chart from a repository
 func DownloadChart(repoURL, chartName, chartVersion string) (io.ReadCloser, error) {
 	// Get the chart URL from the index
-	chartURL, err := getChartURL(repoURL, chartName, chartVersion)
+	chartURL, err := ChartURL(repoURL, chartName, chartVersion)
+	if err != nil {
+		return nil, err
+	}
+	return Download(chartURL)
+}
+
+// ChartURL looks up the download URL of a chart version in the repository
+// index, with the default policy.
+func ChartURL(repoURL, chartName, chartVersion string) (string, error) {
+	c, err := NewClient(repoURL, Policy{})
+	if err != nil {
+		return "", err
+	}
+	return c.ChartURL(context.Background(), chartName, chartVersion)
+}
+
+// Download downloads a chart from its URL, with the default policy.
+func Download(chartURL string) (io.ReadCloser, error) {
+	c, err := NewClient(chartURL, Policy{})
+	if err != nil {
+		return nil, err
+	}
+	return c.Download(context.Background(), chartURL)
+}
+
+// ChartURL looks up the download URL of a chart version in the repository
+// index
+func (c *Client) ChartURL(ctx context.Context, chartName, chartVersion string) (string, error) {
+	chartURL, _, err := c.Chart(ctx, chartName, chartVersion)
+	return chartURL, err
+}
+
+// Chart looks up the download URL of a chart version in the repository index,
+// and the sha256 digest of the archive if the index lists one.
+func (c *Client) Chart(ctx context.Context, chartName, chartVersion string) (chartURL, digest string, err error) {
+	entry, err := c.getChartEntry(ctx, chartName, chartVersion)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get chart URL: %w", err)
+		return "", "", fmt.Errorf("failed to get chart URL: %w", err)
 	}
+	return entry.URLs[0], strings.ToLower(entry.Digest), nil
+}
 
-	// Download the chart
-	resp, err := http.Get(chartURL)
+// Download downloads a chart from its URL
+func (c *Client) Download(ctx context.Context, chartURL string) (io.ReadCloser, error) {
+	resp, err := c.get(ctx, chartURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to download chart: %w", err)
 	}
@@ -41,51 +146,107 @@ func DownloadChart(repoURL, chartName, chartVersion string) (io.ReadCloser, erro
 	return resp.Body, nil
 }
 
-// getChartURL retrieves the download URL for a specific chart version
-func getChartURL(repoURL, chartName, chartVersion string) (string, error) {
+// get requests u if the policy allows it. The body of the response is
+// limited to the maximum download size.
+func (c *Client) get(ctx context.Context, u string) (*http.Response, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.policy.checkURL(parsed, c.repoHost); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkProxied(req); err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	max := c.policy.maxDownloadSize()
+	if resp.ContentLength > max {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s is %d bytes, more than %d", ErrTooLarge, parsed.Redacted(), resp.ContentLength, max)
+	}
+	resp.Body = limitBody(resp.Body, max)
+	return resp, nil
+}
+
+// checkProxied checks the target of a request that goes through an HTTP
+// proxy. The dialer only sees the proxy then, so the host is resolved here
+// and refused if it is internal, or can't be resolved to be checked.
+func (c *Client) checkProxied(req *http.Request) error {
+	if c.policy.AllowPrivateNetworks || req.URL.Hostname() == c.repoHost || c.transport.Proxy == nil {
+		return nil
+	}
+	if proxy, err := c.transport.Proxy(req); err != nil || proxy == nil {
+		return err
+	}
+	if _, err := publicAddrs(req.Context(), req.URL.Hostname()); err != nil {
+		if errors.Is(err, ErrBlocked) {
+			return err
+		}
+		return fmt.Errorf("%w: %s: can't check host through proxy: %v", ErrBlocked, req.URL.Redacted(), err)
+	}
+	return nil
+}
+
+// getChartEntry retrieves the index entry of a specific chart version, with
+// its download URL resolved and checked
+func (c *Client) getChartEntry(ctx context.Context, chartName, chartVersion string) (ChartEntry, error) {
 	// Download and parse the index.yaml file
-	indexURL := fmt.Sprintf("%s/index.yaml", repoURL)
+	indexURL := fmt.Sprintf("%s/index.yaml", c.repoURL)
 
-	resp, err := http.Get(indexURL)
+	resp, err := c.get(ctx, indexURL)
 	if err != nil {
-		return "", fmt.Errorf("failed to download index.yaml: %w", err)
+		return ChartEntry{}, fmt.Errorf("failed to download index.yaml: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to download index.yaml, status: %d", resp.StatusCode)
+		return ChartEntry{}, fmt.Errorf("failed to download index.yaml, status: %d", resp.StatusCode)
 	}
 
 	indexData, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("failed to read index.yaml: %w", err)
+		return ChartEntry{}, fmt.Errorf("failed to read index.yaml: %w", err)
 	}
 
 	var index ChartIndex
 	if err := yaml.Unmarshal(indexData, &index); err != nil {
-		return "", fmt.Errorf("failed to parse index.yaml: %w", err)
+		return ChartEntry{}, fmt.Errorf("failed to parse index.yaml: %w", err)
 	}
 
 	// Find the chart URL
 	entries, ok := index.Entries[chartName]
 	if !ok {
-		return "", fmt.Errorf("chart %s not found in index", chartName)
+		return ChartEntry{}, fmt.Errorf("chart %s %w", chartName, ErrNotFound)
 	}
 
 	for _, entry := range entries {
 		if entry.Version == chartVersion {
 			if len(entry.URLs) == 0 {
-				return "", fmt.Errorf("no URLs found for chart %s version %s", chartName, chartVersion)
+				return ChartEntry{}, fmt.Errorf("no URLs found for chart %s version %s", chartName, chartVersion)
 			}
 			chartURL := entry.URLs[0]
 
 			// If the URL is relative, prepend the repo URL
 			if !strings.HasPrefix(chartURL, "http") {
-				chartURL = fmt.Sprintf("%s/%s", repoURL, chartURL)
+				chartURL = fmt.Sprintf("%s/%s", c.repoURL, chartURL)
+			}
+			if u, err := url.Parse(chartURL); err != nil {
+				return ChartEntry{}, fmt.Errorf("invalid URL %q for chart %s version %s: %w", chartURL, chartName, chartVersion, err)
+			} else if err := c.policy.checkURL(u, c.repoHost); err != nil {
+				return ChartEntry{}, err
 			}
-			return chartURL, nil
+			entry.URLs = []string{chartURL}
+			return entry, nil
 		}
 	}
 
-	return "", fmt.Errorf("version %s not found for chart %s", chartVersion, chartName)
+	return ChartEntry{}, fmt.Errorf("version %s of chart %s %w", chartVersion, chartName, ErrNotFound)
 }
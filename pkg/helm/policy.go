@@ -0,0 +1,193 @@
+package helm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+)
+
+// Defaults of Policy.
+const (
+	DefaultMaxRedirects    = 5
+	DefaultMaxDownloadSize = 100 << 20
+)
+
+var (
+	// ErrBlocked is wrapped by the errors of requests that the outbound
+	// policy refuses to make.
+	ErrBlocked = errors.New("blocked by outbound policy")
+
+	// ErrTooLarge is wrapped by the errors of downloads larger than the
+	// policy allows.
+	ErrTooLarge = errors.New("download too large")
+)
+
+// Policy restricts what is downloaded from upstream. Repository indexes are
+// not trusted: they could point the proxy at internal services, such as cloud
+// metadata endpoints.
+type Policy struct {
+	// AllowedHosts are globs of the hosts that chart URLs and redirects
+	// may point to, besides that of the repository. Empty allows any host.
+	AllowedHosts []string
+
+	// AllowPrivateNetworks allows connections to private, loopback and
+	// link-local addresses. The repository's own host, and HTTP proxies
+	// from the environment, are always allowed. Through a proxy, hosts are
+	// resolved and checked before the request, and refused if they can't
+	// be resolved.
+	AllowPrivateNetworks bool
+
+	// MaxRedirects is the number of redirects followed, DefaultMaxRedirects
+	// if zero and none if negative.
+	MaxRedirects int
+
+	// MaxDownloadSize is the size in bytes of the largest index or chart
+	// downloaded, DefaultMaxDownloadSize if zero.
+	MaxDownloadSize int64
+}
+
+// checkURL checks that u may be requested by a client of the repository on
+// repoHost.
+func (p Policy) checkURL(u *url.URL, repoHost string) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: %s: scheme %q is not allowed", ErrBlocked, u.Redacted(), u.Scheme)
+	}
+	host := u.Hostname()
+	if host == repoHost || len(p.AllowedHosts) == 0 {
+		return nil
+	}
+	for _, g := range p.AllowedHosts {
+		if ok, _ := path.Match(g, host); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s: host %s is not allowed for this repository", ErrBlocked, u.Redacted(), host)
+}
+
+func (p Policy) maxRedirects() int {
+	switch {
+	case p.MaxRedirects < 0:
+		return 0
+	case p.MaxRedirects == 0:
+		return DefaultMaxRedirects
+	}
+	return p.MaxRedirects
+}
+
+func (p Policy) maxDownloadSize() int64 {
+	if p.MaxDownloadSize <= 0 {
+		return DefaultMaxDownloadSize
+	}
+	return p.MaxDownloadSize
+}
+
+// sharedAddressSpace is 100.64.0.0/10, used for carrier-grade NAT and by
+// some clouds for their metadata services.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// internalAddr reports whether connecting to addr could reach something that
+// is not on the public internet.
+func internalAddr(addr netip.Addr) bool {
+	return addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() || addr.IsMulticast() ||
+		addr.IsUnspecified() || sharedAddressSpace.Contains(addr)
+}
+
+// publicAddrs resolves host, and fails if any of its addresses is internal.
+func publicAddrs(ctx context.Context, host string) ([]netip.Addr, error) {
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	for i, ip := range ips {
+		ip = ip.Unmap()
+		ips[i] = ip
+		if internalAddr(ip) {
+			return nil, fmt.Errorf("%w: %s resolves to internal address %s", ErrBlocked, host, ip)
+		}
+	}
+	return ips, nil
+}
+
+// policyDialer dials only public addresses, except on trusted hosts. Hosts
+// are resolved here rather than by the dialer, so that the addresses checked
+// are those connected to.
+type policyDialer struct {
+	dialer  *net.Dialer
+	trusted map[string]bool
+}
+
+func (d *policyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.trusted[host] {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+	ips, err := publicAddrs(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, ip := range ips {
+		conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// environmentProxies returns the hosts of the HTTP proxies configured in the
+// environment.
+func environmentProxies() []string {
+	var hosts []string
+	for _, scheme := range []string{"http", "https"} {
+		req := &http.Request{URL: &url.URL{Scheme: scheme, Host: "example.com"}}
+		if u, err := http.ProxyFromEnvironment(req); err == nil && u != nil {
+			hosts = append(hosts, u.Hostname())
+		}
+	}
+	return hosts
+}
+
+// limitBody fails reads of rc past max bytes.
+func limitBody(rc io.ReadCloser, max int64) io.ReadCloser {
+	return &limitedBody{rc: rc, left: max, max: max}
+}
+
+type limitedBody struct {
+	rc        io.ReadCloser
+	left, max int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.left < 0 {
+		return 0, b.tooLarge()
+	}
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.rc.Read(p)
+	b.left -= int64(n)
+	if b.left < 0 {
+		return n, b.tooLarge()
+	}
+	return n, err
+}
+
+func (b *limitedBody) tooLarge() error {
+	return fmt.Errorf("%w: more than %d bytes", ErrTooLarge, b.max)
+}
+
+func (b *limitedBody) Close() error {
+	return b.rc.Close()
+}
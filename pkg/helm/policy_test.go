@@ -0,0 +1,153 @@
+package helm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPolicyCheckURL(t *testing.T) {
+	restricted := Policy{AllowedHosts: []string{"*.github.io", "charts.example.com"}}
+	tests := []struct {
+		name   string
+		policy Policy
+		url    string
+		ok     bool
+	}{
+		{"any host", Policy{}, "https://elsewhere.example.org/chart.tgz", true},
+		{"repository host", restricted, "https://repo.example.net/chart.tgz", true},
+		{"repository host with port", restricted, "https://repo.example.net:8443/chart.tgz", true},
+		{"allowed host", restricted, "https://charts.example.com/chart.tgz", true},
+		{"allowed glob", restricted, "https://argoproj.github.io/chart.tgz", true},
+		{"glob needs a subdomain", restricted, "https://github.io/chart.tgz", false},
+		{"glob spans labels", restricted, "https://a.b.github.io/chart.tgz", true},
+		{"other host", restricted, "https://evil.example.org/chart.tgz", false},
+		{"metadata endpoint", restricted, "http://169.254.169.254/latest/meta-data", false},
+		{"file scheme", Policy{}, "file:///etc/passwd", false},
+		{"ftp scheme", Policy{}, "ftp://repo.example.net/chart.tgz", false},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		err = tt.policy.checkURL(u, "repo.example.net")
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: checkURL(%s) = %v, want ok %v", tt.name, tt.url, err, tt.ok)
+		}
+		if err != nil && !errors.Is(err, ErrBlocked) {
+			t.Errorf("%s: checkURL(%s) = %v, want ErrBlocked", tt.name, tt.url, err)
+		}
+	}
+}
+
+func TestInternalAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"8.8.8.8", false},
+		{"140.82.112.3", false},
+		{"2606:4700::1111", false},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"127.0.0.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"100.127.255.254", true},
+		{"100.128.0.1", false},
+		{"0.0.0.0", true},
+		{"224.0.0.1", true},
+		{"::1", true},
+		{"::", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"ff02::1", true},
+	}
+	for _, tt := range tests {
+		if got := internalAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("internalAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestPublicAddrs(t *testing.T) {
+	tests := []struct {
+		host string
+		ok   bool
+	}{
+		{"8.8.8.8", true},
+		{"127.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"169.254.169.254", false},
+	}
+	for _, tt := range tests {
+		_, err := publicAddrs(context.Background(), tt.host)
+		if (err == nil) != tt.ok {
+			t.Errorf("publicAddrs(%s) = %v, want ok %v", tt.host, err, tt.ok)
+		}
+		if err != nil && !errors.Is(err, ErrBlocked) {
+			t.Errorf("publicAddrs(%s) = %v, want ErrBlocked", tt.host, err)
+		}
+	}
+}
+
+func TestPolicyDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	d := &policyDialer{dialer: &net.Dialer{}, trusted: map[string]bool{}}
+	if _, err := d.DialContext(context.Background(), "tcp", l.Addr().String()); !errors.Is(err, ErrBlocked) {
+		t.Errorf("dialing loopback = %v, want ErrBlocked", err)
+	}
+
+	d.trusted["127.0.0.1"] = true
+	conn, err := d.DialContext(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dialing a trusted host: %v", err)
+	}
+	conn.Close()
+}
+
+func TestLimitBody(t *testing.T) {
+	tests := []struct {
+		size, max int
+		ok        bool
+	}{
+		{0, 10, true},
+		{10, 10, true},
+		{11, 10, false},
+		{1000, 10, false},
+	}
+	for _, tt := range tests {
+		body := limitBody(io.NopCloser(strings.NewReader(strings.Repeat("a", tt.size))), int64(tt.max))
+		b, err := io.ReadAll(body)
+		if (err == nil) != tt.ok {
+			t.Errorf("reading %d bytes with max %d = %v, want ok %v", tt.size, tt.max, err, tt.ok)
+		}
+		if err != nil && !errors.Is(err, ErrTooLarge) {
+			t.Errorf("reading %d bytes with max %d = %v, want ErrTooLarge", tt.size, tt.max, err)
+		}
+		if len(b) > tt.max+1 {
+			t.Errorf("reading %d bytes with max %d returned %d bytes", tt.size, tt.max, len(b))
+		}
+	}
+}
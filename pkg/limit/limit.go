@@ -0,0 +1,192 @@
+// Package limit limits how much each client may ask of the proxy.
+package limit
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tuananh/helm-oci-proxy/pkg/auth"
+	"github.com/tuananh/helm-oci-proxy/pkg/serve"
+	"golang.org/x/time/rate"
+)
+
+// idleAfter is how long a client's state is kept after its last request.
+const idleAfter = 10 * time.Minute
+
+// ClientKey identifies the client of a request: its identity if it
+// authenticated, its IP address otherwise.
+func ClientKey(r *http.Request, trustForwardedFor bool) string {
+	if id, ok := auth.FromContext(r.Context()); ok && id.Subject != "" {
+		return "user:" + id.Subject
+	}
+	return "ip:" + ClientAddr(r, trustForwardedFor)
+}
+
+// ClientAddr returns the IP address of the client of a request. With
+// trustForwardedFor, it is the last one in X-Forwarded-For, the client as seen
+// by the load balancer in front of the proxy.
+func ClientAddr(r *http.Request, trustForwardedFor bool) string {
+	if trustForwardedFor {
+		if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+			hops := strings.Split(xff[len(xff)-1], ",")
+			if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// TooManyRequests reports that a client is over a limit, and when it may try
+// again.
+func TooManyRequests(w http.ResponseWriter, retryAfter time.Duration, what string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	serve.Error(w, fmt.Errorf("%w: %s", serve.ErrTooManyRequests, what))
+}
+
+// Limiter is a token bucket per client.
+type Limiter struct {
+	limit rate.Limit
+	burst int
+	key   func(*http.Request) string
+
+	mu      sync.Mutex
+	clients map[string]*client
+	swept   time.Time
+}
+
+type client struct {
+	limiter *rate.Limiter
+	seen    time.Time
+}
+
+// NewLimiter returns a limiter allowing each client perSecond requests per
+// second, in bursts of up to burst. Clients are told apart by key, e.g.
+// ClientKey.
+func NewLimiter(perSecond float64, burst int, key func(*http.Request) string) *Limiter {
+	return &Limiter{
+		limit:   rate.Limit(perSecond),
+		burst:   burst,
+		key:     key,
+		clients: map[string]*client{},
+		swept:   time.Now(),
+	}
+}
+
+// Wrap returns next behind the limiter. A limiter keyed by identity must run
+// after authentication; one keyed by address before it, so that failed
+// attempts are limited too.
+func (l *Limiter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := l.reserve(l.key(r))
+		if delay := res.Delay(); delay > 0 {
+			res.Cancel()
+			TooManyRequests(w, delay, "request rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (l *Limiter) reserve(key string) *rate.Reservation {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.swept) > idleAfter {
+		for k, c := range l.clients {
+			if now.Sub(c.seen) > idleAfter {
+				delete(l.clients, k)
+			}
+		}
+		l.swept = now
+	}
+	c, ok := l.clients[key]
+	if !ok {
+		c = &client{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[key] = c
+	}
+	c.seen = now
+	return c.limiter.ReserveN(now, 1)
+}
+
+// Quota allows each key a number of events per fixed window.
+type Quota struct {
+	max    int
+	window time.Duration
+
+	mu      sync.Mutex
+	windows map[string]*quotaWindow
+	swept   time.Time
+}
+
+type quotaWindow struct {
+	start time.Time
+	count int
+}
+
+// NewQuota returns a quota of max events per window.
+func NewQuota(max int, window time.Duration) *Quota {
+	return &Quota{max: max, window: window, windows: map[string]*quotaWindow{}, swept: time.Now()}
+}
+
+// Check reports whether an event for key would be within its quota, without
+// recording it. If not, it returns how long until the window of key ends.
+func (q *Quota) Check(key string) (bool, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	if w, ok := q.windows[key]; ok && now.Sub(w.start) < q.window && w.count >= q.max {
+		return false, w.start.Add(q.window).Sub(now)
+	}
+	return true, 0
+}
+
+// Allow records an event for key if it is within its quota. Otherwise it
+// returns how long until the window of key ends.
+func (q *Quota) Allow(key string) (bool, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(q.swept) > q.window {
+		for k, w := range q.windows {
+			if now.Sub(w.start) >= q.window {
+				delete(q.windows, k)
+			}
+		}
+		q.swept = now
+	}
+	w, ok := q.windows[key]
+	if !ok || now.Sub(w.start) >= q.window {
+		w = &quotaWindow{start: now}
+		q.windows[key] = w
+	}
+	if w.count >= q.max {
+		return false, w.start.Add(q.window).Sub(now)
+	}
+	w.count++
+	return true, 0
+}
+
+// Refund takes back an event recorded for key by Allow, e.g. when another
+// quota refused the request after all.
+func (q *Quota) Refund(key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if w, ok := q.windows[key]; ok && w.count > 0 {
+		w.count--
+	}
+}
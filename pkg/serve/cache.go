@@ -0,0 +1,526 @@
+package serve
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/tuananh/helm-oci-proxy/pkg/types"
+)
+
+// cacheMetrics aggregates the counters of all CachedStorage instances and is
+// published on /debug/vars.
+var cacheMetrics = expvar.NewMap("storage_cache")
+
+func init() {
+	cacheMetrics.Set("hit_ratio", expvar.Func(func() any {
+		return hitRatio(counterValue("hits"), counterValue("misses"))
+	}))
+}
+
+func counterValue(key string) int64 {
+	if v, ok := cacheMetrics.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func hitRatio(hits, misses int64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// CacheStats reports the effectiveness of a CachedStorage.
+type CacheStats struct {
+	Hits          int64   `json:"hits"`
+	Misses        int64   `json:"misses"`
+	HitRatio      float64 `json:"hitRatio"`
+	Evictions     int64   `json:"evictions"`
+	DiskEvictions int64   `json:"diskEvictions"`
+	MemoryBytes   int64   `json:"memoryBytes"`
+	DiskBytes     int64   `json:"diskBytes"`
+}
+
+// CachedStorage is a StorageBackend that keeps recently used small objects in
+// a size-bounded in-memory LRU, with an optional on-disk tier, in front of
+// another backend.
+//
+// Digest-addressed objects are immutable, and their content is checked
+// against the digest before it is cached, so the cache can never serve stale
+// or corrupt data. Tag pointers are kept in memory for a short while too, so
+// that a cached pull by tag doesn't reach the backend; writes through this
+// storage drop them, but those of other processes are only seen once they
+// expire.
+type CachedStorage struct {
+	backend       StorageBackend
+	maxObjectSize int64
+	tagTTL        time.Duration
+
+	mem  *lru
+	disk *diskCache
+
+	hits, misses atomic.Int64
+}
+
+// defaultTagTTL is how long tag pointers are cached when no TTL is
+// configured.
+const defaultTagTTL = 30 * time.Second
+
+// NewCachedStorage wraps backend with a hot cache.
+func NewCachedStorage(backend StorageBackend, config types.CacheConfig) (*CachedStorage, error) {
+	c := &CachedStorage{
+		backend:       backend,
+		maxObjectSize: config.MaxObjectSize,
+		tagTTL:        config.TagTTL,
+		mem:           newLRU(config.MemorySize),
+	}
+	if c.maxObjectSize <= 0 {
+		c.maxObjectSize = 1 << 20
+	}
+	if c.tagTTL <= 0 {
+		c.tagTTL = defaultTagTTL
+	}
+	if config.Dir != "" {
+		disk, err := newDiskCache(config.Dir, config.DiskSize)
+		if err != nil {
+			return nil, err
+		}
+		c.disk = disk
+	}
+	return c, nil
+}
+
+// Stats returns the cache counters of this instance.
+func (c *CachedStorage) Stats() CacheStats {
+	s := CacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.mem.evictions.Load(),
+	}
+	s.HitRatio = hitRatio(s.Hits, s.Misses)
+	s.MemoryBytes = c.mem.bytes()
+	if c.disk != nil {
+		s.DiskEvictions = c.disk.lru.evictions.Load()
+		s.DiskBytes = c.disk.lru.bytes()
+	}
+	return s
+}
+
+// Open serves the object from memory or disk if possible, and fills the cache
+// from the backend otherwise.
+func (c *CachedStorage) Open(ctx context.Context, name string) (io.ReadSeekCloser, Descriptor, error) {
+	if objectKind(name) == "tags" {
+		return c.openTag(ctx, name)
+	}
+	if !isDigest(name) {
+		return c.backend.Open(ctx, name)
+	}
+
+	if e, ok := c.mem.get(name); ok {
+		c.hit()
+		return nopCloser{bytes.NewReader(e.data)}, e.desc, nil
+	}
+	if c.disk != nil {
+		if f, desc, ok := c.disk.open(name); ok {
+			c.hit()
+			return f, desc, nil
+		}
+	}
+	c.miss()
+
+	rc, desc, err := c.backend.Open(ctx, name)
+	if err != nil || desc.Size > c.maxObjectSize {
+		return rc, desc, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, Descriptor{}, err
+	}
+	h, _, err := v1.SHA256(bytes.NewReader(data))
+	if err != nil || h.String() != name {
+		// Don't cache content that doesn't match its name; hand it out as
+		// read so that the caller sees what the backend holds.
+		slog.WarnContext(ctx, "not caching blob with mismatched digest", "name", name, "actual", h)
+		return nopCloser{bytes.NewReader(data)}, desc, nil
+	}
+	desc.Digest, desc.Size = h, int64(len(data))
+
+	c.mem.add(name, &cacheEntry{data: data, desc: desc})
+	if c.disk != nil {
+		if err := c.disk.add(name, desc, data); err != nil {
+			slog.WarnContext(ctx, "failed to write blob to disk cache", "name", name, "err", err)
+		}
+	}
+	return nopCloser{bytes.NewReader(data)}, desc, nil
+}
+
+// openTag serves a tag pointer from memory until it expires, and reads it
+// from the backend otherwise. The manifest it holds is checked against the
+// digest it was written with before it is cached.
+func (c *CachedStorage) openTag(ctx context.Context, name string) (io.ReadSeekCloser, Descriptor, error) {
+	if e, ok := c.tag(name); ok {
+		c.hit()
+		return nopCloser{bytes.NewReader(e.data)}, e.desc, nil
+	}
+	c.miss()
+
+	rc, desc, err := c.backend.Open(ctx, name)
+	if err != nil || desc.Size > c.maxObjectSize || desc.Digest == (v1.Hash{}) {
+		return rc, desc, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, Descriptor{}, err
+	}
+	if h, _, err := v1.SHA256(bytes.NewReader(data)); err == nil && h == desc.Digest {
+		desc.Size = int64(len(data))
+		c.mem.add(name, &cacheEntry{data: data, desc: desc, expires: time.Now().Add(c.tagTTL)})
+	}
+	return nopCloser{bytes.NewReader(data)}, desc, nil
+}
+
+// tag returns the cached tag pointer name, unless it has expired.
+func (c *CachedStorage) tag(name string) (*cacheEntry, bool) {
+	e, ok := c.mem.get(name)
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		c.mem.remove(name)
+		return nil, false
+	}
+	return e, true
+}
+
+// Stat answers from the cache for digest-addressed objects and tag pointers
+// it holds.
+func (c *CachedStorage) Stat(ctx context.Context, name string) (Descriptor, error) {
+	if objectKind(name) == "tags" {
+		if e, ok := c.tag(name); ok {
+			return e.desc, nil
+		}
+	}
+	if isDigest(name) {
+		if e, ok := c.mem.get(name); ok {
+			return e.desc, nil
+		}
+		if c.disk != nil {
+			if desc, ok := c.disk.stat(name); ok {
+				return desc, nil
+			}
+		}
+	}
+	return c.backend.Stat(ctx, name)
+}
+
+// Put writes through to the backend, dropping the cached tag pointer name.
+func (c *CachedStorage) Put(ctx context.Context, name string, desc Descriptor, r io.Reader) error {
+	if !isDigest(name) {
+		c.forget(name)
+	}
+	return c.backend.Put(ctx, name, desc, r)
+}
+
+// Create writes through to the backend.
+func (c *CachedStorage) Create(ctx context.Context, name string, desc Descriptor, r io.Reader) error {
+	return Create(ctx, c.backend, name, desc, r)
+}
+
+// Replace writes through to the backend, dropping the cached tag pointer
+// name.
+func (c *CachedStorage) Replace(ctx context.Context, name, version string, desc Descriptor, r io.Reader) error {
+	c.forget(name)
+	return Replace(ctx, c.backend, name, version, desc, r)
+}
+
+// Delete removes the object from the cache and the backend.
+func (c *CachedStorage) Delete(ctx context.Context, name string) error {
+	c.forget(name)
+	return c.backend.Delete(ctx, name)
+}
+
+// DeleteVersion removes the object from the cache, and from the backend if
+// it is still version.
+func (c *CachedStorage) DeleteVersion(ctx context.Context, name, version string) error {
+	c.forget(name)
+	return DeleteVersion(ctx, c.backend, name, version)
+}
+
+func (c *CachedStorage) forget(name string) {
+	c.mem.remove(name)
+	if c.disk != nil {
+		c.disk.lru.remove(name)
+	}
+}
+
+// List lists the names in the backend.
+func (c *CachedStorage) List(ctx context.Context, prefix string, fn func(name string) error) error {
+	return c.backend.List(ctx, prefix, fn)
+}
+
+func (c *CachedStorage) hit() {
+	c.hits.Add(1)
+	cacheMetrics.Add("hits", 1)
+}
+
+func (c *CachedStorage) miss() {
+	c.misses.Add(1)
+	cacheMetrics.Add("misses", 1)
+}
+
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error { return nil }
+
+type cacheEntry struct {
+	data []byte
+	desc Descriptor
+	// expires is when a tag pointer entry goes stale. Digest-addressed
+	// entries never do.
+	expires time.Time
+}
+
+// lru is a size-bounded least recently used set of entries. Entries are
+// accounted by their descriptor size.
+type lru struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	ll       *list.List
+	items    map[string]*list.Element
+	// onEvict is called with the lock held for every entry that is dropped.
+	onEvict func(name string)
+
+	evictions atomic.Int64
+	metric    string
+}
+
+type lruItem struct {
+	name  string
+	entry *cacheEntry
+}
+
+func newLRU(maxBytes int64) *lru {
+	return &lru{maxBytes: maxBytes, ll: list.New(), items: map[string]*list.Element{}, metric: "evictions"}
+}
+
+func (l *lru) get(name string) (*cacheEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	el, ok := l.items[name]
+	if !ok {
+		return nil, false
+	}
+	l.ll.MoveToFront(el)
+	return el.Value.(*lruItem).entry, true
+}
+
+func (l *lru) add(name string, entry *cacheEntry) {
+	if entry.desc.Size > l.maxBytes {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if el, ok := l.items[name]; ok {
+		l.ll.MoveToFront(el)
+		return
+	}
+	l.items[name] = l.ll.PushFront(&lruItem{name: name, entry: entry})
+	l.size += entry.desc.Size
+	for l.size > l.maxBytes {
+		el := l.ll.Back()
+		item := el.Value.(*lruItem)
+		l.ll.Remove(el)
+		delete(l.items, item.name)
+		l.size -= item.entry.desc.Size
+		l.evictions.Add(1)
+		cacheMetrics.Add(l.metric, 1)
+		if l.onEvict != nil {
+			l.onEvict(item.name)
+		}
+	}
+}
+
+func (l *lru) remove(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	el, ok := l.items[name]
+	if !ok {
+		return
+	}
+	item := el.Value.(*lruItem)
+	l.ll.Remove(el)
+	delete(l.items, name)
+	l.size -= item.entry.desc.Size
+	if l.onEvict != nil {
+		l.onEvict(name)
+	}
+}
+
+func (l *lru) bytes() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.size
+}
+
+// diskCache keeps blobs as files under dir, next to a small JSON file holding
+// their descriptor. The LRU only tracks descriptors; the data stays on disk.
+type diskCache struct {
+	dir string
+	lru *lru
+}
+
+func newDiskCache(dir string, maxBytes int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cache dir: %w", err)
+	}
+	d := &diskCache{dir: dir, lru: newLRU(maxBytes)}
+	d.lru.metric = "disk_evictions"
+	d.lru.onEvict = func(name string) {
+		os.Remove(d.path(name))
+		os.Remove(d.path(name) + ".json")
+	}
+
+	// Pick up what a previous run left behind, oldest first so that the
+	// most recently written blobs are the last to be evicted.
+	matches, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	type found struct {
+		name string
+		desc Descriptor
+		mod  int64
+	}
+	var entries []found
+	for _, m := range matches {
+		b, err := os.ReadFile(m)
+		if err != nil {
+			continue
+		}
+		var desc Descriptor
+		if err := json.Unmarshal(b, &desc); err != nil {
+			continue
+		}
+		name := desc.Digest.String()
+		if d.path(name) != strings.TrimSuffix(m, ".json") {
+			continue
+		}
+		fi, err := os.Stat(d.path(name))
+		if err != nil || fi.Size() != desc.Size {
+			continue
+		}
+		// A file cut short or corrupted while the proxy was down would
+		// otherwise be served as is, so check its content before trusting it.
+		if !d.holds(name) {
+			slog.Warn("dropping disk cache entry with mismatched digest", "name", name)
+			os.Remove(d.path(name))
+			os.Remove(m)
+			continue
+		}
+		entries = append(entries, found{name: name, desc: desc, mod: fi.ModTime().UnixNano()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].mod < entries[j].mod })
+	for _, e := range entries {
+		d.lru.add(e.name, &cacheEntry{desc: e.desc})
+	}
+	return d, nil
+}
+
+// holds reports whether the file cached for name hashes to name.
+func (d *diskCache) holds(name string) bool {
+	f, err := os.Open(d.path(name))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	h, _, err := v1.SHA256(f)
+	return err == nil && h.String() == name
+}
+
+func (d *diskCache) path(name string) string {
+	// Digests contain a colon, which not every file system accepts.
+	return filepath.Join(d.dir, strings.ReplaceAll(name, ":", "-"))
+}
+
+func (d *diskCache) stat(name string) (Descriptor, bool) {
+	e, ok := d.lru.get(name)
+	if !ok {
+		return Descriptor{}, false
+	}
+	return e.desc, true
+}
+
+func (d *diskCache) open(name string) (io.ReadSeekCloser, Descriptor, bool) {
+	desc, ok := d.stat(name)
+	if !ok {
+		return nil, Descriptor{}, false
+	}
+	f, err := os.Open(d.path(name))
+	if err != nil {
+		return nil, Descriptor{}, false
+	}
+	return f, desc, true
+}
+
+func (d *diskCache) add(name string, desc Descriptor, data []byte) error {
+	if desc.Size > d.lru.maxBytes {
+		return nil
+	}
+	meta, err := json.Marshal(desc)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename, so that readers never see a
+	// partially written blob.
+	if err := writeFileAtomic(d.path(name), data); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(d.path(name)+".json", meta); err != nil {
+		return err
+	}
+	d.lru.add(name, &cacheEntry{desc: desc})
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package serve
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// ServeCatalog serves the distribution-spec catalog of repos, paginated with
+// the n and last query parameters.
+func ServeCatalog(w http.ResponseWriter, r *http.Request, repos []string) {
+	page, next := paginate(r, repos)
+	if next != "" {
+		setNextLink(w, r, next)
+	}
+	writeJSON(w, struct {
+		Repositories []string `json:"repositories"`
+	}{page})
+}
+
+// ServeTags serves the distribution-spec tag list of the repository name,
+// paginated with the n and last query parameters.
+func ServeTags(w http.ResponseWriter, r *http.Request, name string, tags []string) {
+	page, next := paginate(r, tags)
+	if next != "" {
+		setNextLink(w, r, next)
+	}
+	writeJSON(w, struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}{name, page})
+}
+
+// paginate returns the page of the sorted list selected by the n and last
+// query parameters, and the last item of the page if there are more.
+func paginate(r *http.Request, list []string) ([]string, string) {
+	if list == nil {
+		list = []string{}
+	}
+	q := r.URL.Query()
+	if last := q.Get("last"); last != "" {
+		list = list[sort.SearchStrings(list, last):]
+		if len(list) > 0 && list[0] == last {
+			list = list[1:]
+		}
+	}
+	n, err := strconv.Atoi(q.Get("n"))
+	if err != nil || n < 0 || n >= len(list) {
+		return list, ""
+	}
+	if n == 0 {
+		return []string{}, ""
+	}
+	return list[:n], list[n-1]
+}
+
+func setNextLink(w http.ResponseWriter, r *http.Request, last string) {
+	q := url.Values{}
+	q.Set("n", r.URL.Query().Get("n"))
+	q.Set("last", last)
+	w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, q.Encode()))
+}
+
+func writeJSON(w http.ResponseWriter, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,145 @@
+package serve
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"golang.org/x/sync/errgroup"
+)
+
+// CopyOptions controls Copy.
+type CopyOptions struct {
+	// Prefix limits the copy to names that start with it.
+	Prefix string
+
+	// Concurrency is the number of objects copied in parallel.
+	Concurrency int
+
+	// DryRun lists what would be copied without writing anything.
+	DryRun bool
+}
+
+// CopyResult summarises a Copy.
+type CopyResult struct {
+	Copied  int
+	Skipped int
+	Failed  int
+	Bytes   int64
+	Deleted int // Objects removed from the destination, by Resync
+}
+
+// Copy copies every object of src to dst: blobs, tag pointers and their
+// metadata. Objects that dst already holds with the same size and digest are
+// skipped, so an interrupted copy resumes where it left off. Content is
+// checked against its digest while it is copied; objects that don't match are
+// removed from dst again and counted as failed.
+func Copy(ctx context.Context, src, dst StorageBackend, opts CopyOptions) (CopyResult, error) {
+	var (
+		mu  sync.Mutex
+		res CopyResult
+	)
+	count := func(f func()) {
+		mu.Lock()
+		defer mu.Unlock()
+		f()
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(opts.Concurrency, 1))
+	err := src.List(gctx, opts.Prefix, func(name string) error {
+		g.Go(func() error {
+			copied, n, err := copyOne(gctx, src, dst, name, opts.DryRun)
+			switch {
+			case errors.Is(err, ErrBlobUnknown):
+				// Deleted since it was listed.
+			case err != nil:
+				if gctx.Err() != nil {
+					return gctx.Err()
+				}
+				slog.ErrorContext(gctx, "copy failed", "name", name, "err", err)
+				count(func() { res.Failed++ })
+			case copied:
+				count(func() { res.Copied++; res.Bytes += n })
+			default:
+				count(func() { res.Skipped++ })
+			}
+			return nil
+		})
+		return nil
+	})
+	if werr := g.Wait(); err == nil {
+		err = werr
+	}
+	if err != nil {
+		return res, err
+	}
+	if res.Failed > 0 {
+		return res, fmt.Errorf("failed to copy %d objects", res.Failed)
+	}
+	return res, nil
+}
+
+// copyOne copies a single object unless dst already has it. It reports
+// whether the object was copied and how many bytes were written.
+func copyOne(ctx context.Context, src, dst StorageBackend, name string, dryRun bool) (bool, int64, error) {
+	sdesc, err := src.Stat(ctx, name)
+	if err != nil {
+		return false, 0, err
+	}
+	ddesc, err := dst.Stat(ctx, name)
+	if err == nil && sameObject(sdesc, ddesc) {
+		return false, 0, nil
+	} else if err != nil && !errors.Is(err, ErrBlobUnknown) {
+		return false, 0, err
+	}
+	if dryRun {
+		slog.InfoContext(ctx, "copy", "name", name, "size", sdesc.Size, "dryRun", true)
+		return true, sdesc.Size, nil
+	}
+
+	rc, desc, err := src.Open(ctx, name)
+	if err != nil {
+		return false, 0, err
+	}
+	defer rc.Close()
+
+	// Blobs are checked against their name, everything else against the
+	// digest recorded in its metadata, if any. Quarantined blobs are known not
+	// to match and are copied as they are.
+	want := desc.Digest
+	if h, err := v1.NewHash(name); err == nil {
+		want = h
+	} else if strings.HasPrefix(name, QuarantineName("")) {
+		want = v1.Hash{}
+	}
+	h := sha256.New()
+	if err := dst.Put(ctx, name, desc, io.TeeReader(rc, h)); err != nil {
+		return false, 0, err
+	}
+	if want.Algorithm == "sha256" {
+		if got := hex.EncodeToString(h.Sum(nil)); got != want.Hex {
+			if err := dst.Delete(ctx, name); err != nil {
+				slog.ErrorContext(ctx, "failed to remove mismatched copy", "name", name, "err", err)
+			}
+			return false, 0, fmt.Errorf("%w: %s hashes to sha256:%s", ErrDigestMismatch, name, got)
+		}
+	}
+	return true, desc.Size, nil
+}
+
+// sameObject reports whether dst already holds the content of src. Without a
+// digest to compare, a copy is only current if it is not older than src.
+func sameObject(src, dst Descriptor) bool {
+	if src.Size != dst.Size || src.Digest != dst.Digest {
+		return false
+	}
+	return src.Digest != (v1.Hash{}) || !dst.LastModified.Before(src.LastModified)
+}
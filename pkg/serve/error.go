@@ -10,17 +10,54 @@ import (
 
 var ErrNotFound = errors.New("not found")
 
+// RegistryError is an error that is reported to clients with a
+// distribution-spec error code.
+type RegistryError struct {
+	Code    string
+	Status  int
+	Message string
+}
+
+func (e *RegistryError) Error() string {
+	return e.Message
+}
+
+var (
+	// ErrBlobUnknown is returned by storage backends when the requested
+	// object does not exist.
+	ErrBlobUnknown = &RegistryError{Code: "BLOB_UNKNOWN", Status: http.StatusNotFound, Message: "blob unknown to registry"}
+
+	// ErrNameUnknown is reported when a repository is not known to the proxy.
+	ErrNameUnknown = &RegistryError{Code: "NAME_UNKNOWN", Status: http.StatusNotFound, Message: "repository name not known to registry"}
+
+	// ErrManifestUnknown is reported when a requested manifest does not exist.
+	ErrManifestUnknown = &RegistryError{Code: "MANIFEST_UNKNOWN", Status: http.StatusNotFound, Message: "manifest unknown"}
+
+	// ErrUnauthorized is reported when a client did not authenticate.
+	ErrUnauthorized = &RegistryError{Code: "UNAUTHORIZED", Status: http.StatusUnauthorized, Message: "authentication required"}
+
+	// ErrDenied is reported when a client may not access a resource.
+	ErrDenied = &RegistryError{Code: "DENIED", Status: http.StatusForbidden, Message: "requested access to the resource is denied"}
+
+	// ErrTooManyRequests is reported when a client is over a rate limit.
+	ErrTooManyRequests = &RegistryError{Code: "TOOMANYREQUESTS", Status: http.StatusTooManyRequests, Message: "too many requests"}
+)
+
 func Error(w http.ResponseWriter, err error) {
 	code := "MANIFEST_UNKNOWN"
 	httpCode := http.StatusNotFound
 	if terr, ok := err.(*transport.Error); ok {
-		http.Error(w, "", terr.StatusCode)
-		json.NewEncoder(w).Encode(terr.Errors)
+		writeError(w, terr.StatusCode, terr.Errors)
 		return
 	}
 
-	http.Error(w, "", httpCode)
-	json.NewEncoder(w).Encode(&resp{
+	var rerr *RegistryError
+	if errors.As(err, &rerr) {
+		code = rerr.Code
+		httpCode = rerr.Status
+	}
+
+	writeError(w, httpCode, &resp{
 		Errors: []e{{
 			Code:    code,
 			Message: err.Error(),
@@ -28,6 +65,13 @@ func Error(w http.ResponseWriter, err error) {
 	})
 }
 
+func writeError(w http.ResponseWriter, httpCode int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(httpCode)
+	json.NewEncoder(w).Encode(body)
+}
+
 type resp struct {
 	Errors []e `json:"errors"`
 }
@@ -0,0 +1,203 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// GCOptions controls GarbageCollect.
+type GCOptions struct {
+	// GracePeriod protects blobs written less than this long ago. A build
+	// writes its blobs before the tag pointer that references them, so a
+	// blob can look unreferenced for as long as a build takes. Builds only
+	// write again blobs they reuse once those are BlobTouchInterval old, so
+	// the grace period must be longer than that plus the longest build.
+	GracePeriod time.Duration
+
+	// DryRun reports what would be deleted without deleting anything.
+	DryRun bool
+}
+
+// GCResult summarises a garbage collection run.
+type GCResult struct {
+	TagPointers  int
+	Blobs        int
+	Reachable    int
+	Deleted      int
+	DeletedBytes int64
+	DeletedLinks int
+}
+
+// IsTagPointer reports whether name is a tag pointer, i.e. a manifest stored
+// under a name other than its digest. Tag pointers are the roots that keep
+// blobs alive.
+func IsTagPointer(name string) bool {
+	if isDigest(name) {
+		return false
+	}
+	return objectKind(name) == "tags" || !strings.Contains(name, "/")
+}
+
+// GarbageCollect deletes digest-addressed blobs that are not reachable from
+// any tag pointer: the manifest a pointer refers to, and the config and layers
+// of that manifest.
+//
+// It is safe to run while the proxy keeps serving. Blobs younger than the
+// grace period are kept, including old blobs a running build reuses, since
+// it writes them again; tag pointers written while the collection runs are
+// also marked again right before anything is deleted.
+func GarbageCollect(ctx context.Context, st StorageBackend, opts GCOptions) (GCResult, error) {
+	var res GCResult
+	start := time.Now()
+
+	var blobs, pointers, links []string
+	if err := st.List(ctx, "", func(name string) error {
+		switch {
+		case isDigest(name):
+			blobs = append(blobs, name)
+		case IsTagPointer(name):
+			pointers = append(pointers, name)
+		case objectKind(name) == "links":
+			links = append(links, name)
+		}
+		return nil
+	}); err != nil {
+		return res, fmt.Errorf("failed to list storage: %w", err)
+	}
+	res.Blobs, res.TagPointers = len(blobs), len(pointers)
+
+	// Mark. Any pointer that can't be read aborts the run, since we can't
+	// tell what it keeps alive.
+	reachable := map[string]bool{}
+	for _, name := range pointers {
+		if err := markManifest(ctx, st, name, reachable); err != nil {
+			return res, err
+		}
+	}
+
+	var candidates []string
+	for _, name := range blobs {
+		if !reachable[name] {
+			candidates = append(candidates, name)
+		}
+	}
+
+	// Re-mark from pointers written since we started, in case a build
+	// reused one of the candidates in the meantime.
+	if len(candidates) > 0 {
+		if err := st.List(ctx, "", func(name string) error {
+			if !IsTagPointer(name) {
+				return nil
+			}
+			desc, err := st.Stat(ctx, name)
+			if errors.Is(err, ErrBlobUnknown) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if !desc.LastModified.Before(start) {
+				return markManifest(ctx, st, name, reachable)
+			}
+			return nil
+		}); err != nil {
+			return res, fmt.Errorf("failed to list storage: %w", err)
+		}
+	}
+	res.Reachable = len(reachable)
+
+	// Sweep.
+	kept := map[string]bool{}
+	for _, name := range blobs {
+		kept[name] = true
+	}
+	for _, name := range candidates {
+		if reachable[name] {
+			continue
+		}
+		desc, err := st.Stat(ctx, name)
+		if errors.Is(err, ErrBlobUnknown) {
+			continue
+		} else if err != nil {
+			return res, err
+		}
+		if time.Since(desc.LastModified) < opts.GracePeriod {
+			continue
+		}
+
+		slog.InfoContext(ctx, "gc: unreferenced blob", "name", name, "size", desc.Size, "lastModified", desc.LastModified, "dryRun", opts.DryRun)
+		if !opts.DryRun {
+			if err := st.Delete(ctx, name); err != nil {
+				return res, err
+			}
+		}
+		res.Deleted++
+		res.DeletedBytes += desc.Size
+		delete(kept, name)
+	}
+
+	// Links to blobs that are gone. Links are written after their blob, so
+	// the grace period also covers a link to a blob written since we listed.
+	for _, name := range links {
+		if kept[path.Base(name)] {
+			continue
+		}
+		desc, err := st.Stat(ctx, name)
+		if errors.Is(err, ErrBlobUnknown) {
+			continue
+		} else if err != nil {
+			return res, err
+		}
+		if time.Since(desc.LastModified) < opts.GracePeriod {
+			continue
+		}
+		slog.InfoContext(ctx, "gc: dangling link", "name", name, "dryRun", opts.DryRun)
+		if !opts.DryRun {
+			if err := st.Delete(ctx, name); err != nil {
+				return res, err
+			}
+		}
+		res.DeletedLinks++
+	}
+	return res, nil
+}
+
+// markManifest marks the manifest stored under name, its config and layers as
+// reachable.
+func markManifest(ctx context.Context, st StorageBackend, name string, reachable map[string]bool) error {
+	rc, desc, err := st.Open(ctx, name)
+	if errors.Is(err, ErrBlobUnknown) {
+		// Deleted since it was listed.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	m, err := v1.ParseManifest(rc)
+	if err != nil {
+		return fmt.Errorf("failed to parse manifest %s: %w", name, err)
+	}
+
+	digest := desc.Digest
+	if digest == (v1.Hash{}) {
+		if _, err := rc.Seek(0, 0); err != nil {
+			return err
+		}
+		if digest, _, err = v1.SHA256(rc); err != nil {
+			return err
+		}
+	}
+	reachable[digest.String()] = true
+	reachable[m.Config.Digest.String()] = true
+	for _, l := range m.Layers {
+		reachable[l.Digest.String()] = true
+	}
+	return nil
+}
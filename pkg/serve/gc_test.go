@@ -0,0 +1,189 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func newTestLocalStorage(t *testing.T) *LocalStorage {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, metaDir), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return &LocalStorage{root: dir}
+}
+
+// age sets the modification time of the objects names in st to d ago.
+func age(t *testing.T, st *LocalStorage, d time.Duration, names ...string) {
+	t.Helper()
+	when := time.Now().Add(-d)
+	for _, name := range names {
+		if err := os.Chtimes(st.path(name), when, when); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testImage writes a random image to st, with its manifest under the tag
+// pointers in also, and returns the digests of its blobs.
+func testImage(t *testing.T, st StorageBackend, also ...string) (v1.Image, []string) {
+	t.Helper()
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteImage(context.Background(), st, img, also...); err != nil {
+		t.Fatalf("WriteImage: %v", err)
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := []string{digest.String(), m.Config.Digest.String()}
+	for _, l := range m.Layers {
+		blobs = append(blobs, l.Digest.String())
+	}
+	return img, blobs
+}
+
+func exists(t *testing.T, st StorageBackend, name string) bool {
+	t.Helper()
+	_, err := st.Stat(context.Background(), name)
+	if errors.Is(err, ErrBlobUnknown) {
+		return false
+	} else if err != nil {
+		t.Fatalf("Stat %s: %v", name, err)
+	}
+	return true
+}
+
+func TestGarbageCollectGrace(t *testing.T) {
+	tests := []struct {
+		name        string
+		age         time.Duration // Of the unreferenced blobs
+		grace       time.Duration
+		dryRun      bool
+		wantCounted bool // Reported as deleted
+		wantDeleted bool
+	}{
+		{"no grace", 0, 0, false, true, true},
+		{"older than the grace period", 2 * time.Hour, time.Hour, false, true, true},
+		{"within the grace period", 30 * time.Minute, time.Hour, false, false, false},
+		{"dry run", 2 * time.Hour, time.Hour, true, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			st := newTestLocalStorage(t)
+			_, kept := testImage(t, st, "argo/tags/up/kept/1.0.0")
+			_, orphans := testImage(t, st)
+			age(t, st, tt.age, orphans...)
+			link := LinkName("argo/orphan", orphans[0])
+			if err := st.Put(ctx, link, Descriptor{}, bytes.NewReader(nil)); err != nil {
+				t.Fatal(err)
+			}
+			age(t, st, tt.age, link)
+
+			res, err := GarbageCollect(ctx, st, GCOptions{GracePeriod: tt.grace, DryRun: tt.dryRun})
+			if err != nil {
+				t.Fatalf("GarbageCollect: %v", err)
+			}
+
+			wantCount := 0
+			if tt.wantCounted {
+				wantCount = len(orphans)
+			}
+			if res.Deleted != wantCount {
+				t.Errorf("Deleted = %d, want %d", res.Deleted, wantCount)
+			}
+			for _, name := range kept {
+				if !exists(t, st, name) {
+					t.Errorf("reachable blob %s deleted", name)
+				}
+			}
+			for _, name := range append(orphans, link) {
+				if got := !exists(t, st, name); got != tt.wantDeleted {
+					t.Errorf("%s deleted = %v, want %v", name, got, tt.wantDeleted)
+				}
+			}
+		})
+	}
+}
+
+// hookStorage calls fn once, after the first List.
+type hookStorage struct {
+	*LocalStorage
+	once sync.Once
+	fn   func()
+}
+
+func (s *hookStorage) List(ctx context.Context, prefix string, fn func(name string) error) error {
+	err := s.LocalStorage.List(ctx, prefix, fn)
+	s.once.Do(s.fn)
+	return err
+}
+
+func TestGarbageCollectRemarks(t *testing.T) {
+	ctx := context.Background()
+	st := newTestLocalStorage(t)
+	img, blobs := testImage(t, st)
+	age(t, st, 2*time.Hour, blobs...)
+
+	// A build reuses the blobs while gc runs, and writes its tag pointer
+	// after gc listed the storage.
+	hooked := &hookStorage{LocalStorage: st, fn: func() {
+		b, err := img.RawManifest()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err := st.Put(ctx, "argo/tags/up/reused/1.0.0", Descriptor{}, bytes.NewReader(b)); err != nil {
+			t.Error(err)
+		}
+	}}
+	res, err := GarbageCollect(ctx, hooked, GCOptions{})
+	if err != nil {
+		t.Fatalf("GarbageCollect: %v", err)
+	}
+	if res.Deleted != 0 {
+		t.Errorf("Deleted = %d, want 0", res.Deleted)
+	}
+	for _, name := range blobs {
+		if !exists(t, st, name) {
+			t.Errorf("blob %s of a pointer written during gc deleted", name)
+		}
+	}
+}
+
+func TestGarbageCollectUnreadablePointer(t *testing.T) {
+	ctx := context.Background()
+	st := newTestLocalStorage(t)
+	_, blobs := testImage(t, st)
+	age(t, st, 2*time.Hour, blobs...)
+	if err := st.Put(ctx, "argo/tags/up/broken/1.0.0", Descriptor{}, bytes.NewReader([]byte("{not json"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GarbageCollect(ctx, st, GCOptions{}); err == nil {
+		t.Fatal("GarbageCollect with an unreadable pointer succeeded, want an error")
+	}
+	for _, name := range blobs {
+		if !exists(t, st, name) {
+			t.Errorf("blob %s deleted despite an unreadable pointer", name)
+		}
+	}
+}
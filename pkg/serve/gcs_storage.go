@@ -1,20 +1,21 @@
 package serve
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"strconv"
 	"time"
 
 	"cloud.google.com/go/storage"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	ocitypes "github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/tuananh/helm-oci-proxy/pkg/types"
-	"golang.org/x/sync/errgroup"
 	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
 )
 
 // GCSStorage implements the StorageBackend interface for Google Cloud Storage
@@ -24,8 +25,12 @@ type GCSStorage struct {
 	client   *storage.Client
 }
 
-// New creates a new GCSStorage instance
-func (s *GCSStorage) New(ctx context.Context, config types.StorageConfig) (StorageBackend, error) {
+func init() {
+	RegisterBackend("gcs", NewGCSStorage)
+}
+
+// NewGCSStorage creates a new GCSStorage instance
+func NewGCSStorage(ctx context.Context, config types.StorageConfig) (StorageBackend, error) {
 	endpoint := config.Endpoint
 	if endpoint == "" {
 		endpoint = "https://storage.googleapis.com"
@@ -47,231 +52,188 @@ func (s *GCSStorage) New(ctx context.Context, config types.StorageConfig) (Stora
 	}, nil
 }
 
-// Blob streams the blob from GCS instead of redirecting
-func (s *GCSStorage) Blob(w http.ResponseWriter, r *http.Request, name string) {
-	ctx := r.Context()
-
-	obj := s.client.Bucket(s.bucket).Object(fmt.Sprintf("blobs/%s", name))
+// Open opens the blob for reading from GCS. Reads are pinned to the object
+// generation that was current when it was opened.
+func (s *GCSStorage) Open(ctx context.Context, name string) (io.ReadSeekCloser, Descriptor, error) {
+	obj := s.client.Bucket(s.bucket).Object(name)
 
 	attrs, err := obj.Attrs(ctx)
 	if err != nil {
-		if err == storage.ErrObjectNotExist {
-			http.Error(w, fmt.Sprintf("Blob %s not found", name), http.StatusNotFound)
-			return
-		}
-		http.Error(w, fmt.Sprintf("Failed to get blob attributes: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", attrs.ContentType)
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", attrs.Size))
-	if digest := attrs.Metadata["Docker-Content-Digest"]; digest != "" {
-		w.Header().Set("Docker-Content-Digest", digest)
-	}
-
-	// If it's just a HEAD request, we're done
-	if r.Method == http.MethodHead {
-		return
+		return nil, Descriptor{}, s.error(name, err)
 	}
-
-	reader, err := obj.NewReader(ctx)
+	desc, err := gcsDescriptor(attrs)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to read blob: %v", err), http.StatusInternalServerError)
-		return
+		return nil, Descriptor{}, err
 	}
-	defer reader.Close()
 
-	// Stream the content to the response
-	if _, err := io.Copy(w, reader); err != nil {
-		// Check if it's a context cancellation
-		if err == context.Canceled || (ctx.Err() == context.Canceled) {
-			// Client disconnected - this is normal, just log at debug level
-			slog.DebugContext(ctx, "Client disconnected while streaming blob",
-				"name", name)
-			return
+	obj = obj.Generation(attrs.Generation)
+	return newRangeReader(ctx, desc.Size, func(ctx context.Context, offset int64) (io.ReadCloser, error) {
+		reader, err := obj.NewRangeReader(ctx, offset, -1)
+		if err != nil {
+			return nil, s.error(name, err)
 		}
-		// Log other errors as they might be important
-		slog.ErrorContext(ctx, "Error streaming blob",
-			"name", name,
-			"error", err)
-	}
+		return reader, nil
+	}), desc, nil
 }
 
-// BlobExists checks if a blob exists in GCS
-func (s *GCSStorage) BlobExists(ctx context.Context, name string) (v1.Descriptor, error) {
-	obj, err := s.client.Bucket(s.bucket).Object(fmt.Sprintf("blobs/%s", name)).Attrs(ctx)
+// Stat checks if a blob exists in GCS
+func (s *GCSStorage) Stat(ctx context.Context, name string) (Descriptor, error) {
+	attrs, err := s.client.Bucket(s.bucket).Object(name).Attrs(ctx)
 	if err != nil {
-		return v1.Descriptor{}, err
+		return Descriptor{}, s.error(name, err)
 	}
-	var h v1.Hash
-	if d := obj.Metadata["Docker-Content-Digest"]; d != "" {
-		h, err = v1.NewHash(d)
-		if err != nil {
-			return v1.Descriptor{}, err
-		}
-	}
-
-	return v1.Descriptor{
-		Digest:    h,
-		MediaType: ocitypes.MediaType(obj.ContentType),
-		Size:      obj.Size,
-	}, nil
+	return gcsDescriptor(attrs)
 }
 
-// WriteObject writes a string object to GCS
-func (s *GCSStorage) WriteObject(ctx context.Context, name, contents string) error {
-	w := s.client.Bucket(s.bucket).Object(fmt.Sprintf("blobs/%s", name)).
-		If(storage.Conditions{DoesNotExist: true}).
-		NewWriter(ctx)
-	if _, err := fmt.Fprintln(w, contents); err != nil {
-		if herr, ok := err.(*googleapi.Error); ok && herr.Code == http.StatusPreconditionFailed {
-			return nil
-		}
-		return fmt.Errorf("fmt.Fprintln: %v", err)
+// Put writes a blob to GCS
+func (s *GCSStorage) Put(ctx context.Context, name string, desc Descriptor, r io.Reader) error {
+	start := time.Now()
+	defer func() { slog.InfoContext(ctx, "gcsPut", "name", name, "took", time.Since(start)) }()
+
+	// Cancelling the writer's context aborts the upload, so a failed copy
+	// never leaves a truncated object behind.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := s.client.Bucket(s.bucket).Object(name).NewWriter(ctx)
+	w.ObjectAttrs.ContentType = string(desc.MediaType)
+	if desc.Digest != (v1.Hash{}) {
+		w.Metadata = map[string]string{"Docker-Content-Digest": desc.Digest.String()}
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("copy: %w", err)
 	}
 	if err := w.Close(); err != nil {
-		if herr, ok := err.(*googleapi.Error); ok && herr.Code == http.StatusPreconditionFailed {
-			return nil
-		}
-		return fmt.Errorf("w.Close: %v", err)
+		return fmt.Errorf("w.Close: %w", err)
 	}
 	return nil
 }
 
-// WriteBlob writes a blob to GCS
-func (s *GCSStorage) WriteBlob(ctx context.Context, name string, h v1.Hash, rc io.ReadCloser, contentType string) error {
-	start := time.Now()
-	defer func() { slog.InfoContext(ctx, "gcsWriteBlob(%q) took %s", name, time.Since(start)) }()
-
-	// The DoesNotExist precondition can be hit when writing or flushing
-	// data, which can happen any of three places. Anywhere it happens,
-	// just ignore the error since that means the blob already exists.
-	w := s.client.Bucket(s.bucket).Object(fmt.Sprintf("blobs/%s", name)).
-		If(storage.Conditions{DoesNotExist: true}).
-		NewWriter(ctx)
-	w.ObjectAttrs.ContentType = contentType
-	w.Metadata = map[string]string{"Docker-Content-Digest": h.String()}
+// Create writes a blob to GCS unless it already exists
+func (s *GCSStorage) Create(ctx context.Context, name string, desc Descriptor, r io.Reader) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	if _, err := io.Copy(w, rc); err != nil {
-		if herr, ok := err.(*googleapi.Error); ok && herr.Code == http.StatusPreconditionFailed {
-			return nil
-		}
-		return fmt.Errorf("copy: %v", err)
+	obj := s.client.Bucket(s.bucket).Object(name).If(storage.Conditions{DoesNotExist: true})
+	w := obj.NewWriter(ctx)
+	w.ObjectAttrs.ContentType = string(desc.MediaType)
+	if desc.Digest != (v1.Hash{}) {
+		w.Metadata = map[string]string{"Docker-Content-Digest": desc.Digest.String()}
 	}
-	if err := rc.Close(); err != nil {
-		if herr, ok := err.(*googleapi.Error); ok && herr.Code == http.StatusPreconditionFailed {
-			return nil
-		}
-		return fmt.Errorf("rc.Close: %v", err)
+
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("copy: %w", err)
 	}
 	if err := w.Close(); err != nil {
-		if herr, ok := err.(*googleapi.Error); ok && herr.Code == http.StatusPreconditionFailed {
-			return nil
+		if isPreconditionFailed(err) {
+			return fmt.Errorf("%w: %s", ErrObjectExists, name)
 		}
-		return fmt.Errorf("w.Close: %v", err)
+		return fmt.Errorf("w.Close: %w", err)
 	}
 	return nil
 }
 
-// WriteImage writes the layer blobs, config blob and manifest to GCS
-func (s *GCSStorage) WriteImage(ctx context.Context, img v1.Image, also ...string) error {
-	// Write config blob for later serving.
-	ch, err := img.ConfigName()
+// Replace writes a blob to GCS if it is still at the generation version.
+func (s *GCSStorage) Replace(ctx context.Context, name, version string, desc Descriptor, r io.Reader) error {
+	gen, err := strconv.ParseInt(version, 10, 64)
 	if err != nil {
-		return err
-	}
-	cb, err := img.RawConfigFile()
-	if err != nil {
-		return err
-	}
-	if err := s.WriteBlob(ctx, ch.String(), ch, io.NopCloser(bytes.NewReader(cb)), "application/json"); err != nil {
-		return err
+		return fmt.Errorf("gcs %s: invalid generation %q", name, version)
 	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	// Write layer blobs for later serving.
-	layers, err := img.Layers()
-	if err != nil {
-		return err
-	}
-	var g errgroup.Group
-	for _, l := range layers {
-		l := l
-		g.Go(func() error {
-			rc, err := l.Compressed()
-			if err != nil {
-				return err
-			}
-			lh, err := l.Digest()
-			if err != nil {
-				return err
-			}
-			mt, err := l.MediaType()
-			if err != nil {
-				return err
-			}
-			return s.WriteBlob(ctx, lh.String(), lh, rc, string(mt))
-		})
-	}
-	if err := g.Wait(); err != nil {
-		return err
+	obj := s.client.Bucket(s.bucket).Object(name).If(storage.Conditions{GenerationMatch: gen})
+	w := obj.NewWriter(ctx)
+	w.ObjectAttrs.ContentType = string(desc.MediaType)
+	if desc.Digest != (v1.Hash{}) {
+		w.Metadata = map[string]string{"Docker-Content-Digest": desc.Digest.String()}
 	}
 
-	// Write the manifest as a blob.
-	b, err := img.RawManifest()
-	if err != nil {
-		return err
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("copy: %w", err)
 	}
-	mt, err := img.MediaType()
-	if err != nil {
-		return err
+	if err := w.Close(); err != nil {
+		if isPreconditionFailed(err) {
+			return fmt.Errorf("%w: %s", ErrObjectChanged, name)
+		}
+		return fmt.Errorf("w.Close: %w", err)
 	}
-	digest, err := img.Digest()
+	return nil
+}
+
+// DeleteVersion removes a blob from GCS if it is still at the generation
+// version.
+func (s *GCSStorage) DeleteVersion(ctx context.Context, name, version string) error {
+	gen, err := strconv.ParseInt(version, 10, 64)
 	if err != nil {
-		return err
-	}
-	if err := s.WriteBlob(ctx, digest.String(), digest, io.NopCloser(bytes.NewReader(b)), string(mt)); err != nil {
-		return err
+		return fmt.Errorf("gcs %s: invalid generation %q", name, version)
 	}
-	for _, a := range also {
-		a := a
-		g.Go(func() error {
-			return s.WriteBlob(ctx, a, digest, io.NopCloser(bytes.NewReader(b)), string(mt))
-		})
+	err = s.client.Bucket(s.bucket).Object(name).If(storage.Conditions{GenerationMatch: gen}).Delete(ctx)
+	switch {
+	case err == nil, errors.Is(err, storage.ErrObjectNotExist):
+		return nil
+	case isPreconditionFailed(err):
+		return fmt.Errorf("%w: %s", ErrObjectChanged, name)
 	}
-	return g.Wait()
+	return fmt.Errorf("failed to delete blob: %w", err)
 }
 
-// ServeManifest writes config and layer blobs for the image, then writes and
-// redirects to the image manifest contents pointing to those blobs.
-func (s *GCSStorage) ServeManifest(w http.ResponseWriter, r *http.Request, img v1.Image, also ...string) error {
-	ctx := r.Context()
+// isPreconditionFailed reports whether err is GCS refusing a conditional
+// request.
+func isPreconditionFailed(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed
+}
 
-	if err := s.WriteImage(ctx, img, also...); err != nil {
-		return err
+// Delete removes a blob from GCS
+func (s *GCSStorage) Delete(ctx context.Context, name string) error {
+	err := s.client.Bucket(s.bucket).Object(name).Delete(ctx)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("failed to delete blob: %w", err)
 	}
+	return nil
+}
 
-	digest, err := img.Digest()
-	if err != nil {
+// List lists the objects in the bucket that start with prefix
+func (s *GCSStorage) List(ctx context.Context, prefix string, fn func(name string) error) error {
+	query := &storage.Query{Prefix: prefix}
+	if err := query.SetAttrSelection([]string{"Name"}); err != nil {
 		return err
 	}
-
-	// If it's just a HEAD request, serve that.
-	if r.Method == http.MethodHead {
-		mt, err := img.MediaType()
-		if err != nil {
-			return err
+	it := s.client.Bucket(s.bucket).Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
 		}
-		size, err := img.Size()
 		if err != nil {
+			return fmt.Errorf("failed to list objects: %w", err)
+		}
+		if err := fn(attrs.Name); err != nil {
 			return err
 		}
-		w.Header().Set("Docker-Content-Digest", digest.String())
-		w.Header().Set("Content-Type", string(mt))
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
-		return nil
 	}
+}
 
-	// Redirect to manifest blob.
-	s.Blob(w, r, digest.String())
-	return nil
+// error maps GCS "not found" errors to ErrBlobUnknown.
+func (s *GCSStorage) error(name string, err error) error {
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("%w: %s", ErrBlobUnknown, name)
+	}
+	return fmt.Errorf("gcs %s: %w", name, err)
+}
+
+func gcsDescriptor(attrs *storage.ObjectAttrs) (Descriptor, error) {
+	h, err := parseDigest(attrs.Metadata["Docker-Content-Digest"])
+	if err != nil {
+		return Descriptor{}, err
+	}
+	return Descriptor{
+		Digest:       h,
+		MediaType:    ocitypes.MediaType(attrs.ContentType),
+		Size:         attrs.Size,
+		LastModified: attrs.Updated,
+		Version:      strconv.FormatInt(attrs.Generation, 10),
+	}, nil
 }
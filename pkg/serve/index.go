@@ -0,0 +1,253 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// IndexName returns the name of the index entry of the tag pointer tagName.
+func IndexName(tagName string) string {
+	ns, key, _ := strings.Cut(tagName, "/tags/")
+	return ns + "/index/" + key
+}
+
+// IndexEntry describes a cached chart version. Entries are kept next to the
+// tag pointers, one object per pointer, so that what is cached can be listed
+// without parsing manifests.
+type IndexEntry struct {
+	TagName   string `json:"tagName"`
+	Namespace string `json:"namespace"`
+	Chart     string `json:"chart"`
+	Version   string `json:"version"`
+
+	// Digest is the digest of the manifest, Size the total size of the
+	// manifest, its config and layers.
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+
+	// Upstream is the URL the chart was downloaded from, if known.
+	Upstream string `json:"upstream,omitempty"`
+	// Verification is how the chart was checked against the upstream
+	// index when it was built, e.g. "verified", if known.
+	Verification string `json:"verification,omitempty"`
+
+	BuiltAt time.Time `json:"builtAt"`
+	// LastPulled is updated at most once per AccessLog interval.
+	LastPulled time.Time `json:"lastPulled,omitzero"`
+}
+
+// IndexTag writes the index entry of the tag pointer tagName from the
+// manifest and chart metadata it refers to. The pull time of an existing
+// entry is kept, as are its upstream URL and verification if upstream is
+// empty.
+func IndexTag(ctx context.Context, st StorageBackend, tagName, upstream, verification string) (IndexEntry, error) {
+	ns, _, ok := strings.Cut(tagName, "/tags/")
+	if !ok {
+		return IndexEntry{}, fmt.Errorf("tag pointer %s has no namespace", tagName)
+	}
+	m, desc, err := ReadManifest(ctx, st, tagName)
+	if err != nil {
+		return IndexEntry{}, err
+	}
+	md, err := ReadChartMetadata(ctx, st, tagName)
+	if err != nil {
+		return IndexEntry{}, err
+	}
+
+	e := IndexEntry{
+		TagName:   tagName,
+		Namespace: ns,
+		Chart:     md.Name,
+		Version:   md.Version,
+		Digest:    desc.Digest.String(),
+		Size:      desc.Size + m.Config.Size,
+		Upstream:  upstream,
+		BuiltAt:   desc.LastModified.UTC(),
+
+		Verification: verification,
+	}
+	for _, l := range m.Layers {
+		e.Size += l.Size
+	}
+	return updateIndexEntry(ctx, st, tagName, func(prev IndexEntry, ok bool) (IndexEntry, bool) {
+		next := e
+		if ok {
+			next.LastPulled = prev.LastPulled
+			if next.Upstream == "" {
+				next.Upstream, next.Verification = prev.Upstream, prev.Verification
+			}
+		}
+		return next, true
+	})
+}
+
+// indexUpdateAttempts is how often updateIndexEntry tries again when the
+// entry changes under it.
+const indexUpdateAttempts = 5
+
+// updateIndexEntry replaces the index entry of tagName with what update
+// makes of it, given the current entry if there is one. An entry that exists
+// is only replaced if it hasn't changed since it was read, so that a build
+// and a pull recording its time don't undo each other; a changed entry is
+// read and updated again. Backends that can't replace conditionally get a
+// plain write. It returns the entry as it is stored.
+func updateIndexEntry(ctx context.Context, st StorageBackend, tagName string, update func(prev IndexEntry, ok bool) (IndexEntry, bool)) (IndexEntry, error) {
+	name := IndexName(tagName)
+	for attempt := 0; attempt < indexUpdateAttempts; attempt++ {
+		prev, version, err := readIndexVersion(ctx, st, name)
+		ok := err == nil
+		if err != nil && !errors.Is(err, ErrBlobUnknown) {
+			return IndexEntry{}, err
+		}
+		e, write := update(prev, ok)
+		if !write {
+			return prev, nil
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			return IndexEntry{}, err
+		}
+		desc := Descriptor{MediaType: "application/json", Size: int64(len(b))}
+
+		if !ok || version == "" {
+			return e, st.Put(ctx, name, desc, bytes.NewReader(b))
+		}
+		err = Replace(ctx, st, name, version, desc, bytes.NewReader(b))
+		switch {
+		case err == nil:
+			return e, nil
+		case errors.Is(err, errors.ErrUnsupported):
+			return e, st.Put(ctx, name, desc, bytes.NewReader(b))
+		case !errors.Is(err, ErrObjectChanged):
+			return IndexEntry{}, err
+		}
+	}
+	return IndexEntry{}, fmt.Errorf("index entry %s kept changing while it was updated", name)
+}
+
+// PutIndexEntry writes e.
+func PutIndexEntry(ctx context.Context, st StorageBackend, e IndexEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	desc := Descriptor{MediaType: "application/json", Size: int64(len(b))}
+	return st.Put(ctx, IndexName(e.TagName), desc, bytes.NewReader(b))
+}
+
+// ReadIndexEntry reads the index entry of the tag pointer tagName. It returns
+// an error wrapping ErrBlobUnknown if there is none.
+func ReadIndexEntry(ctx context.Context, st StorageBackend, tagName string) (IndexEntry, error) {
+	return readIndexEntry(ctx, st, IndexName(tagName))
+}
+
+func readIndexEntry(ctx context.Context, st StorageBackend, name string) (IndexEntry, error) {
+	e, _, err := readIndexVersion(ctx, st, name)
+	return e, err
+}
+
+// readIndexVersion reads the index entry name and the version it is stored
+// as.
+func readIndexVersion(ctx context.Context, st StorageBackend, name string) (IndexEntry, string, error) {
+	rc, desc, err := st.Open(ctx, name)
+	if err != nil {
+		return IndexEntry{}, "", err
+	}
+	defer rc.Close()
+
+	var e IndexEntry
+	if err := json.NewDecoder(io.LimitReader(rc, 1<<20)).Decode(&e); err != nil {
+		return IndexEntry{}, "", fmt.Errorf("failed to parse index entry %s: %w", name, err)
+	}
+	return e, desc.Version, nil
+}
+
+// touchIndexEntry records a pull of tagName at t in its index entry, if it
+// has one.
+func touchIndexEntry(ctx context.Context, st StorageBackend, tagName string, t time.Time) error {
+	_, err := updateIndexEntry(ctx, st, tagName, func(e IndexEntry, ok bool) (IndexEntry, bool) {
+		if !ok || !t.After(e.LastPulled) {
+			return e, false
+		}
+		e.LastPulled = t
+		return e, true
+	})
+	return err
+}
+
+// ListIndex calls fn for every index entry of namespace.
+func ListIndex(ctx context.Context, st StorageBackend, namespace string, fn func(IndexEntry) error) error {
+	return st.List(ctx, namespace+"/index/", func(name string) error {
+		e, err := readIndexEntry(ctx, st, name)
+		if errors.Is(err, ErrBlobUnknown) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return fn(e)
+	})
+}
+
+// listVersions calls fn for the chart and version of every index entry of
+// namespace. Entries are named "<namespace>/index/<upstream>/<chart>/<version>",
+// so only entries of the md5 keys of earlier releases need to be read.
+func listVersions(ctx context.Context, st StorageBackend, namespace string, fn func(chart, version string) error) error {
+	return st.List(ctx, namespace+"/index/", func(name string) error {
+		if parts := strings.Split(strings.TrimPrefix(name, namespace+"/index/"), "/"); len(parts) == 3 {
+			return fn(parts[1], parts[2])
+		}
+		e, err := readIndexEntry(ctx, st, name)
+		if errors.Is(err, ErrBlobUnknown) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return fn(e.Chart, e.Version)
+	})
+}
+
+// Repositories returns the sorted names ("<namespace>/<chart>") of the
+// charts cached in the given namespaces.
+func Repositories(ctx context.Context, st StorageBackend, namespaces []string) ([]string, error) {
+	seen := map[string]bool{}
+	for _, ns := range namespaces {
+		if err := listVersions(ctx, st, ns, func(chart, _ string) error {
+			seen[ns+"/"+chart] = true
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	repos := make([]string, 0, len(seen))
+	for r := range seen {
+		repos = append(repos, r)
+	}
+	sort.Strings(repos)
+	return repos, nil
+}
+
+// Tags returns the sorted versions of chart cached in namespace.
+func Tags(ctx context.Context, st StorageBackend, namespace, chart string) ([]string, error) {
+	seen := map[string]bool{}
+	if err := listVersions(ctx, st, namespace, func(c, version string) error {
+		if c == chart {
+			seen[version] = true
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	tags := make([]string, 0, len(seen))
+	for t := range seen {
+		tags = append(tags, t)
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
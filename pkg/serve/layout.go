@@ -0,0 +1,214 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/tuananh/helm-oci-proxy/pkg/types"
+)
+
+// Layout maps object names to keys in a bucket.
+//
+// Objects are named either by their digest ("sha256:...") or, for objects that
+// belong to a namespace such as tag pointers, by a path "<namespace>/<kind>/...".
+// Digests always live under "<prefix>/blobs/", so they are deduplicated across
+// namespaces. The flat layout puts every other object there too; the
+// namespaced layout keeps them under "<prefix>/<namespace>/" instead, so that
+// tag pointers end up in "<prefix>/<namespace>/tags/".
+type Layout struct {
+	Prefix     string
+	Namespaced bool
+}
+
+// NewLayout returns the layout described by the storage configuration.
+func NewLayout(config types.StorageConfig) (Layout, error) {
+	l := Layout{Prefix: strings.Trim(config.Prefix, "/")}
+	switch config.Layout {
+	case "", "flat":
+	case "namespaced":
+		l.Namespaced = true
+	default:
+		return Layout{}, fmt.Errorf("unsupported storage layout: %s", config.Layout)
+	}
+	return l, nil
+}
+
+// Key returns the bucket key of the named object.
+func (l Layout) Key(name string) string {
+	if l.Namespaced && !isDigest(name) && strings.Contains(name, "/") {
+		return l.join(name)
+	}
+	return l.join("blobs/" + name)
+}
+
+// Name returns the object name stored under key, or false if key is not
+// part of this layout.
+func (l Layout) Name(key string) (string, bool) {
+	if l.Prefix != "" {
+		if !strings.HasPrefix(key, l.Prefix+"/") {
+			return "", false
+		}
+		key = key[len(l.Prefix)+1:]
+	}
+	if name, ok := strings.CutPrefix(key, "blobs/"); ok {
+		return name, true
+	}
+	if l.Namespaced && strings.Contains(key, "/") {
+		return key, true
+	}
+	return "", false
+}
+
+func (l Layout) join(rel string) string {
+	if l.Prefix == "" {
+		return rel
+	}
+	return l.Prefix + "/" + rel
+}
+
+// TagName returns the name of the tag pointer key in namespace.
+func TagName(namespace, key string) string {
+	return namespace + "/tags/" + key
+}
+
+// ParseTagName returns the upstream key, chart and version in the name of a
+// tag pointer "<namespace>/tags/<upstream>/<chart>/<version>", or false for
+// names that don't have them, such as the md5 keys of earlier releases.
+func ParseTagName(tagName string) (upstream, chart, version string, ok bool) {
+	_, key, ok := strings.Cut(tagName, "/tags/")
+	if !ok {
+		return "", "", "", false
+	}
+	parts := strings.Split(key, "/")
+	if len(parts) != 3 || slices.Contains(parts, "") {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], parts[2], true
+}
+
+// objectKinds are the kinds of objects that belong to a namespace, named
+// "<namespace>/<kind>/<key>".
+var objectKinds = []string{"tags", "access", "index", "locks", "links"}
+
+// objectKind returns the kind of a namespaced object name. Keys may contain
+// slashes, and even a kind, so the first kind segment in the name wins.
+func objectKind(name string) string {
+	kind, at := "", len(name)
+	for _, k := range objectKinds {
+		if i := strings.Index(name, "/"+k+"/"); i >= 0 && i < at {
+			kind, at = k, i
+		}
+	}
+	return kind
+}
+
+// RenameTag moves the tag pointer from to the name to, along with its access
+// record and index entry. Pointers of the first releases, named without a
+// namespace, have neither; the pointer is indexed under its new name.
+func RenameTag(ctx context.Context, st StorageBackend, from, to string) error {
+	rc, desc, err := st.Open(ctx, from)
+	if err != nil {
+		return err
+	}
+	err = st.Put(ctx, to, desc, rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+
+	if !strings.Contains(from, "/tags/") {
+		if _, err := IndexTag(ctx, st, to, "", ""); err != nil {
+			return err
+		}
+		return st.Delete(ctx, from)
+	}
+
+	if rc, desc, err := st.Open(ctx, AccessName(from)); err == nil {
+		err = st.Put(ctx, AccessName(to), desc, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	} else if !errors.Is(err, ErrBlobUnknown) {
+		return err
+	}
+
+	if e, err := ReadIndexEntry(ctx, st, from); err == nil {
+		e.TagName = to
+		if err := PutIndexEntry(ctx, st, e); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, ErrBlobUnknown) {
+		return err
+	} else if _, err := IndexTag(ctx, st, to, "", ""); err != nil {
+		return err
+	}
+
+	for _, name := range []string{from, AccessName(from), IndexName(from)} {
+		if err := st.Delete(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// layoutStorage is a StorageBackend that stores objects of a backend under the
+// keys given by a Layout.
+type layoutStorage struct {
+	backend StorageBackend
+	layout  Layout
+}
+
+// NewLayoutStorage returns a StorageBackend that stores named objects in
+// backend under the keys given by layout.
+func NewLayoutStorage(backend StorageBackend, layout Layout) StorageBackend {
+	return &layoutStorage{backend: backend, layout: layout}
+}
+
+func (s *layoutStorage) Open(ctx context.Context, name string) (io.ReadSeekCloser, Descriptor, error) {
+	return s.backend.Open(ctx, s.layout.Key(name))
+}
+
+func (s *layoutStorage) Stat(ctx context.Context, name string) (Descriptor, error) {
+	return s.backend.Stat(ctx, s.layout.Key(name))
+}
+
+func (s *layoutStorage) Put(ctx context.Context, name string, desc Descriptor, r io.Reader) error {
+	return s.backend.Put(ctx, s.layout.Key(name), desc, r)
+}
+
+func (s *layoutStorage) Create(ctx context.Context, name string, desc Descriptor, r io.Reader) error {
+	return Create(ctx, s.backend, s.layout.Key(name), desc, r)
+}
+
+func (s *layoutStorage) Replace(ctx context.Context, name, version string, desc Descriptor, r io.Reader) error {
+	return Replace(ctx, s.backend, s.layout.Key(name), version, desc, r)
+}
+
+func (s *layoutStorage) DeleteVersion(ctx context.Context, name, version string) error {
+	return DeleteVersion(ctx, s.backend, s.layout.Key(name), version)
+}
+
+func (s *layoutStorage) Delete(ctx context.Context, name string) error {
+	return s.backend.Delete(ctx, s.layout.Key(name))
+}
+
+// List lists the names that start with prefix. Namespaces should be given
+// with a trailing slash, e.g. "argo/tags/".
+func (s *layoutStorage) List(ctx context.Context, prefix string, fn func(name string) error) error {
+	keyPrefix := s.layout.Key(prefix)
+	if prefix == "" && s.layout.Namespaced {
+		keyPrefix = s.layout.join("")
+	}
+	return s.backend.List(ctx, keyPrefix, func(key string) error {
+		name, ok := s.layout.Name(key)
+		if !ok || !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		return fn(name)
+	})
+}
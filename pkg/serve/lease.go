@@ -0,0 +1,197 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tuananh/helm-oci-proxy/pkg/types"
+)
+
+// LockName returns the name of the build lease for the tag pointer tagName.
+func LockName(tagName string) string {
+	ns, key, _ := strings.Cut(tagName, "/tags/")
+	return ns + "/locks/" + key
+}
+
+// ErrLeaseLost is returned by Renew when the lease expired and someone else
+// took it over.
+var ErrLeaseLost = errors.New("lease lost")
+
+// Lease is an exclusive claim on a name, held until it is released or
+// expires.
+type Lease interface {
+	// Renew extends the lease to ttl from now. It fails with an error
+	// wrapping ErrLeaseLost if the lease is no longer held.
+	Renew(ctx context.Context, ttl time.Duration) error
+	Release(ctx context.Context) error
+}
+
+// Locker hands out leases, so that only one of several proxy instances does
+// a piece of work, such as building a chart version, at a time.
+type Locker interface {
+	// TryLock takes the lease on name for ttl. It returns false, without
+	// waiting, if someone else holds the lease.
+	TryLock(ctx context.Context, name string, ttl time.Duration) (Lease, bool, error)
+}
+
+// NewLocker creates the Locker described by config. Leases are kept in st
+// unless another type is configured.
+func NewLocker(ctx context.Context, config types.LockConfig, st StorageBackend) (Locker, error) {
+	switch config.Type {
+	case "", "storage":
+		return NewStorageLocker(st), nil
+	case "redis":
+		return NewRedisLocker(ctx, config)
+	default:
+		return nil, fmt.Errorf("unsupported lock type: %s", config.Type)
+	}
+}
+
+// newOwner returns an identifier for the holder of a lease that is unique
+// across processes.
+func newOwner() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+// storageLocker keeps leases as objects in a StorageBackend. Leases are
+// created with a conditional create, so only one writer wins, and taken over
+// or renewed with conditional writes on the version that was read.
+type storageLocker struct {
+	st StorageBackend
+}
+
+// lockRecord is the content of a lease object.
+type lockRecord struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// NewStorageLocker returns a Locker that keeps leases in st. TryLock fails
+// with errors.ErrUnsupported if st can't create objects conditionally.
+func NewStorageLocker(st StorageBackend) Locker {
+	return &storageLocker{st: st}
+}
+
+func (l *storageLocker) TryLock(ctx context.Context, name string, ttl time.Duration) (Lease, bool, error) {
+	owner := newOwner()
+	b, desc, err := encodeLock(owner, ttl)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// A lease left behind by a holder that died is taken over once it has
+	// expired. It is only deleted if it is still the one that was read, so
+	// a lease renewed or taken over in the meantime stays; one retry is
+	// enough, since a racing writer means the lease is held again.
+	for attempt := 0; ; attempt++ {
+		err := Create(ctx, l.st, name, desc, bytes.NewReader(b))
+		if err == nil {
+			return &storageLease{st: l.st, name: name, owner: owner}, true, nil
+		}
+		if !errors.Is(err, ErrObjectExists) {
+			return nil, false, err
+		}
+		if attempt > 0 {
+			return nil, false, nil
+		}
+		held, version, err := readLock(ctx, l.st, name)
+		if errors.Is(err, ErrBlobUnknown) {
+			continue
+		} else if err != nil {
+			return nil, false, err
+		}
+		if time.Now().Before(held.Expires) {
+			return nil, false, nil
+		}
+		if err := DeleteVersion(ctx, l.st, name, version); errors.Is(err, ErrObjectChanged) {
+			return nil, false, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+	}
+}
+
+// encodeLock returns the content of a lease object held by owner for ttl.
+func encodeLock(owner string, ttl time.Duration) ([]byte, Descriptor, error) {
+	b, err := json.Marshal(lockRecord{Owner: owner, Expires: time.Now().Add(ttl).UTC()})
+	if err != nil {
+		return nil, Descriptor{}, err
+	}
+	return b, Descriptor{MediaType: "application/json", Size: int64(len(b))}, nil
+}
+
+// readLock returns the lease object name and its version.
+func readLock(ctx context.Context, st StorageBackend, name string) (lockRecord, string, error) {
+	var rec lockRecord
+	rc, desc, err := st.Open(ctx, name)
+	if err != nil {
+		return rec, "", err
+	}
+	defer rc.Close()
+	if err := json.NewDecoder(io.LimitReader(rc, 4096)).Decode(&rec); err != nil {
+		// Treat an unreadable lease as expired, so that it can't block
+		// builds forever.
+		return lockRecord{}, desc.Version, nil
+	}
+	return rec, desc.Version, nil
+}
+
+// storageLease is a lease held in a StorageBackend.
+type storageLease struct {
+	st    StorageBackend
+	name  string
+	owner string
+}
+
+// Renew rewrites the lease object with a new expiry, if it is still ours.
+func (l *storageLease) Renew(ctx context.Context, ttl time.Duration) error {
+	held, version, err := readLock(ctx, l.st, l.name)
+	if errors.Is(err, ErrBlobUnknown) {
+		return fmt.Errorf("%w: %s", ErrLeaseLost, l.name)
+	} else if err != nil {
+		return err
+	}
+	if held.Owner != l.owner {
+		return fmt.Errorf("%w: %s", ErrLeaseLost, l.name)
+	}
+	b, desc, err := encodeLock(l.owner, ttl)
+	if err != nil {
+		return err
+	}
+	if err := Replace(ctx, l.st, l.name, version, desc, bytes.NewReader(b)); errors.Is(err, ErrObjectChanged) {
+		return fmt.Errorf("%w: %s", ErrLeaseLost, l.name)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Release deletes the lease object, unless it has expired and been taken
+// over in the meantime.
+func (l *storageLease) Release(ctx context.Context) error {
+	held, version, err := readLock(ctx, l.st, l.name)
+	if errors.Is(err, ErrBlobUnknown) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if held.Owner != l.owner {
+		return nil
+	}
+	if err := DeleteVersion(ctx, l.st, l.name, version); err != nil && !errors.Is(err, ErrObjectChanged) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+)
+
+// LinkName returns the name of the link of digest into the repository
+// repoName ("<namespace>/<chart>"). Blobs are shared between namespaces; a
+// link records that a repository references one, so that it is only served
+// through the repositories that do.
+func LinkName(repoName, digest string) string {
+	return path.Dir(repoName) + "/links/" + path.Base(repoName) + "/" + digest
+}
+
+// LinkManifest links the manifest stored under name, its config and its
+// layers into the repository repoName. Links that exist are left as they are,
+// so it is cheap to call again.
+func LinkManifest(ctx context.Context, st StorageBackend, repoName, name string) error {
+	m, desc, err := ReadManifest(ctx, st, name)
+	if err != nil {
+		return err
+	}
+	digests := []string{m.Config.Digest.String()}
+	for _, l := range m.Layers {
+		digests = append(digests, l.Digest.String())
+	}
+	// The manifest goes last: once it is linked, the rest is.
+	digests = append(digests, desc.Digest.String())
+
+	if ok, err := Linked(ctx, st, repoName, desc.Digest.String()); err != nil || ok {
+		return err
+	}
+	for _, d := range digests {
+		if err := st.Put(ctx, LinkName(repoName, d), Descriptor{MediaType: "text/plain", Size: int64(len(d))}, strings.NewReader(d)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Linked reports whether digest is linked into the repository repoName.
+func Linked(ctx context.Context, st StorageBackend, repoName, digest string) (bool, error) {
+	_, err := st.Stat(ctx, LinkName(repoName, digest))
+	if errors.Is(err, ErrBlobUnknown) {
+		return false, nil
+	}
+	return err == nil, err
+}
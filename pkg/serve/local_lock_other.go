@@ -0,0 +1,14 @@
+//go:build !unix
+
+package serve
+
+import (
+	"errors"
+	"fmt"
+)
+
+// lock is only implemented with flock(2), so local storage can't write
+// conditionally on other systems.
+func (s *LocalStorage) lock() (func(), error) {
+	return nil, fmt.Errorf("local storage needs flock for conditional writes: %w", errors.ErrUnsupported)
+}
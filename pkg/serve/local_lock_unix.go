@@ -0,0 +1,26 @@
+//go:build unix
+
+package serve
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lock takes the lock of the store, which conditional writes hold while they
+// check and change an object, and returns the function releasing it. It is
+// an flock(2) lock, so it only excludes processes that see the same lock,
+// such as those on the same host.
+func (s *LocalStorage) lock() (func(), error) {
+	f, err := os.OpenFile(filepath.Join(s.root, metaDir, ".lock"), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	// Closing the file releases the lock.
+	return func() { f.Close() }, nil
+}
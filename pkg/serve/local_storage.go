@@ -0,0 +1,354 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	ocitypes "github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/tuananh/helm-oci-proxy/pkg/types"
+)
+
+func init() {
+	RegisterBackend("local", NewLocalStorage)
+}
+
+// metaDir holds the descriptor of every object, mirroring the object tree.
+const metaDir = ".meta"
+
+// LocalStorage implements the StorageBackend interface on the local file system
+type LocalStorage struct {
+	root string
+}
+
+// localOptions are the storage options of the local backend
+type localOptions struct {
+	Path string `yaml:"path"` // Root directory of the store
+}
+
+// localMeta is the metadata kept for every object
+type localMeta struct {
+	Digest    string `json:"digest,omitempty"`
+	MediaType string `json:"mediaType,omitempty"`
+}
+
+// NewLocalStorage creates a new LocalStorage instance
+func NewLocalStorage(ctx context.Context, config types.StorageConfig) (StorageBackend, error) {
+	var opts localOptions
+	if err := config.Decode(&opts); err != nil {
+		return nil, fmt.Errorf("invalid local storage options: %w", err)
+	}
+	if opts.Path == "" {
+		return nil, fmt.Errorf("path is required for local storage")
+	}
+	if err := os.MkdirAll(filepath.Join(opts.Path, metaDir), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+	return &LocalStorage{root: opts.Path}, nil
+}
+
+// Open opens the blob file for reading
+func (s *LocalStorage) Open(ctx context.Context, name string) (io.ReadSeekCloser, Descriptor, error) {
+	if err := checkName(name); err != nil {
+		return nil, Descriptor{}, err
+	}
+	f, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, Descriptor{}, s.error(name, err)
+	}
+	desc, err := s.stat(name, f)
+	if err != nil {
+		f.Close()
+		return nil, Descriptor{}, err
+	}
+	return f, desc, nil
+}
+
+// Stat checks if a blob file exists
+func (s *LocalStorage) Stat(ctx context.Context, name string) (Descriptor, error) {
+	if err := checkName(name); err != nil {
+		return Descriptor{}, err
+	}
+	return s.stat(name, nil)
+}
+
+func (s *LocalStorage) stat(name string, f *os.File) (Descriptor, error) {
+	var (
+		fi  os.FileInfo
+		err error
+	)
+	if f != nil {
+		fi, err = f.Stat()
+	} else {
+		fi, err = os.Stat(s.path(name))
+	}
+	if err != nil {
+		return Descriptor{}, s.error(name, err)
+	}
+
+	var meta localMeta
+	if b, err := os.ReadFile(s.metaPath(name)); err == nil {
+		if err := json.Unmarshal(b, &meta); err != nil {
+			return Descriptor{}, fmt.Errorf("invalid metadata for %s: %w", name, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return Descriptor{}, err
+	}
+	h, err := parseDigest(meta.Digest)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	return Descriptor{
+		Digest:       h,
+		MediaType:    ocitypes.MediaType(meta.MediaType),
+		Size:         fi.Size(),
+		LastModified: fi.ModTime(),
+		Version:      localVersion(fi),
+	}, nil
+}
+
+// Put writes a blob file. The file is written next to its final location and
+// renamed into place, so readers never see a partial object.
+func (s *LocalStorage) Put(ctx context.Context, name string, desc Descriptor, r io.Reader) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	p := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("copy: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := s.writeMeta(name, desc); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+func (s *LocalStorage) writeMeta(name string, desc Descriptor) error {
+	meta := localMeta{MediaType: string(desc.MediaType)}
+	if desc.Digest != (v1.Hash{}) {
+		meta.Digest = desc.Digest.String()
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.metaPath(name)), 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.metaPath(name), b)
+}
+
+// Create writes a blob file unless it already exists. The complete file is
+// hard-linked into place, which fails if the name is taken, so it needs no
+// lock: Replace and DeleteVersion only change files that exist.
+func (s *LocalStorage) Create(ctx context.Context, name string, desc Descriptor, r io.Reader) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	tmp, err := s.writeTemp(name, r)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err := os.Link(tmp, s.path(name)); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("%w: %s", ErrObjectExists, name)
+		}
+		return err
+	}
+	return s.writeMeta(name, desc)
+}
+
+// Replace writes a blob file if it is still version. The version is checked
+// and the file replaced while holding the store's lock.
+func (s *LocalStorage) Replace(ctx context.Context, name, version string, desc Descriptor, r io.Reader) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	tmp, err := s.writeTemp(name, r)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := s.check(name, version); err != nil {
+		if errors.Is(err, ErrBlobUnknown) {
+			return fmt.Errorf("%w: %s", ErrObjectChanged, name)
+		}
+		return err
+	}
+	if err := os.Rename(tmp, s.path(name)); err != nil {
+		return err
+	}
+	return s.writeMeta(name, desc)
+}
+
+// DeleteVersion removes a blob file if it is still version, like Replace.
+func (s *LocalStorage) DeleteVersion(ctx context.Context, name, version string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := s.check(name, version); err != nil {
+		if errors.Is(err, ErrBlobUnknown) {
+			return nil
+		}
+		return err
+	}
+	return s.Delete(ctx, name)
+}
+
+// check fails with ErrObjectChanged unless the blob file of name is still
+// version.
+func (s *LocalStorage) check(name, version string) error {
+	fi, err := os.Stat(s.path(name))
+	if err != nil {
+		return s.error(name, err)
+	}
+	if localVersion(fi) != version {
+		return fmt.Errorf("%w: %s", ErrObjectChanged, name)
+	}
+	return nil
+}
+
+// writeTemp writes the contents of r to a temporary file next to the blob
+// file of name and returns its path.
+func (s *LocalStorage) writeTemp(name string, r io.Reader) (string, error) {
+	p := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", fmt.Errorf("copy: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// localVersion identifies a blob file. Files are never written in place, so
+// a new object is a new file with its own modification time.
+func localVersion(fi os.FileInfo) string {
+	return fmt.Sprintf("%d-%d", fi.ModTime().UnixNano(), fi.Size())
+}
+
+// Delete removes a blob file
+func (s *LocalStorage) Delete(ctx context.Context, name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if err := os.Remove(s.path(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete blob: %w", err)
+	}
+	if err := os.Remove(s.metaPath(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete blob metadata: %w", err)
+	}
+	return nil
+}
+
+// List walks the store for names that start with prefix
+func (s *LocalStorage) List(ctx context.Context, prefix string, fn func(name string) error) error {
+	// Only walk the directory the prefix points into.
+	dir := s.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = s.path(prefix[:i])
+	}
+	var ferr error
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p == filepath.Join(s.root, metaDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		ferr = fn(name)
+		return ferr
+	})
+	if ferr != nil {
+		return ferr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %w", err)
+	}
+	return nil
+}
+
+// checkName rejects names that would resolve outside of the store.
+func checkName(name string) error {
+	if !filepath.IsLocal(filepath.FromSlash(name)) || strings.HasPrefix(name, metaDir+"/") {
+		return fmt.Errorf("invalid object name %q", name)
+	}
+	return nil
+}
+
+func (s *LocalStorage) path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+func (s *LocalStorage) metaPath(name string) string {
+	return filepath.Join(s.root, metaDir, filepath.FromSlash(name)+".json")
+}
+
+// error maps "not exist" errors to ErrBlobUnknown.
+func (s *LocalStorage) error(name string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrBlobUnknown, name)
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// rangeReader is an io.ReadSeekCloser over a remote object that supports
+// ranged reads. The underlying stream is opened lazily and reopened at the
+// new offset after a Seek, so seeking without reading costs nothing.
+type rangeReader struct {
+	ctx  context.Context
+	size int64
+	// open returns a stream of the object starting at offset.
+	open func(ctx context.Context, offset int64) (io.ReadCloser, error)
+
+	off   int64
+	rc    io.ReadCloser
+	rcOff int64
+}
+
+func newRangeReader(ctx context.Context, size int64, open func(ctx context.Context, offset int64) (io.ReadCloser, error)) *rangeReader {
+	return &rangeReader{ctx: ctx, size: size, open: open}
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	if r.rc != nil && r.rcOff != r.off {
+		r.rc.Close()
+		r.rc = nil
+	}
+	if r.rc == nil {
+		rc, err := r.open(r.ctx, r.off)
+		if err != nil {
+			return 0, err
+		}
+		r.rc, r.rcOff = rc, r.off
+	}
+	n, err := r.rc.Read(p)
+	r.off += int64(n)
+	r.rcOff += int64(n)
+	if err == io.EOF && r.off < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *rangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("seek: invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("seek: negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *rangeReader) Close() error {
+	if r.rc == nil {
+		return nil
+	}
+	err := r.rc.Close()
+	r.rc = nil
+	return err
+}
@@ -0,0 +1,98 @@
+package serve
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/tuananh/helm-oci-proxy/pkg/types"
+)
+
+// redisKeyPrefix namespaces the keys of leases in Redis.
+const redisKeyPrefix = "helm-oci-proxy:lock:"
+
+// releaseScript deletes a lease only if it is still held by the caller.
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// renewScript extends a lease only if it is still held by the caller.
+var renewScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// redisLocker keeps leases as keys in Redis that expire on their own.
+type redisLocker struct {
+	client redis.UniversalClient
+}
+
+// NewRedisLocker returns a Locker that keeps leases in the Redis server
+// configured in config.
+func NewRedisLocker(ctx context.Context, config types.LockConfig) (Locker, error) {
+	if config.Address == "" {
+		return nil, fmt.Errorf("address is required for redis locks")
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr:     config.Address,
+		Username: config.Username,
+		Password: config.Password,
+		DB:       config.DB,
+	})
+	if err := client.Ping(ctx).Err(); err != nil {
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	return NewRedisLockerWithClient(client), nil
+}
+
+// NewRedisLockerWithClient returns a Locker that keeps leases in Redis using
+// client.
+func NewRedisLockerWithClient(client redis.UniversalClient) Locker {
+	return &redisLocker{client: client}
+}
+
+func (l *redisLocker) TryLock(ctx context.Context, name string, ttl time.Duration) (Lease, bool, error) {
+	owner := newOwner()
+	ok, err := l.client.SetNX(ctx, redisKeyPrefix+name, owner, ttl).Result()
+	if err != nil {
+		return nil, false, fmt.Errorf("redis lock %s: %w", name, err)
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	return &redisLease{client: l.client, key: redisKeyPrefix + name, owner: owner}, true, nil
+}
+
+// redisLease is a lease held in Redis.
+type redisLease struct {
+	client redis.UniversalClient
+	key    string
+	owner  string
+}
+
+// Renew extends the lease, if it is still ours.
+func (l *redisLease) Renew(ctx context.Context, ttl time.Duration) error {
+	n, err := renewScript.Run(ctx, l.client, []string{l.key}, l.owner, ttl.Milliseconds()).Int()
+	if err != nil {
+		return fmt.Errorf("redis renew %s: %w", l.key, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: %s", ErrLeaseLost, l.key)
+	}
+	return nil
+}
+
+// Release deletes the lease, unless it has expired and been taken over in
+// the meantime.
+func (l *redisLease) Release(ctx context.Context) error {
+	if err := releaseScript.Run(ctx, l.client, []string{l.key}, l.owner).Err(); err != nil {
+		return fmt.Errorf("redis unlock %s: %w", l.key, err)
+	}
+	return nil
+}
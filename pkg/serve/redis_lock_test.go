@@ -0,0 +1,142 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+const testLockName = "argo/locks/argoproj.github.io_argo-helm/argo-cd/7.0.0"
+
+func newTestRedisLocker(t *testing.T) (*miniredis.Miniredis, Locker) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return mr, NewRedisLockerWithClient(client)
+}
+
+func tryLock(t *testing.T, l Locker, ttl time.Duration) (Lease, bool) {
+	t.Helper()
+	lease, ok, err := l.TryLock(context.Background(), testLockName, ttl)
+	if err != nil {
+		t.Fatalf("TryLock: %v", err)
+	}
+	return lease, ok
+}
+
+func TestRedisLockAcquire(t *testing.T) {
+	mr, l := newTestRedisLocker(t)
+
+	lease, ok := tryLock(t, l, time.Minute)
+	if !ok {
+		t.Fatal("TryLock on a free name: not acquired")
+	}
+	key := redisKeyPrefix + testLockName
+	if !mr.Exists(key) {
+		t.Fatalf("lease key %s not set", key)
+	}
+	if ttl := mr.TTL(key); ttl != time.Minute {
+		t.Errorf("lease TTL = %v, want %v", ttl, time.Minute)
+	}
+
+	if err := lease.Release(context.Background()); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if mr.Exists(key) {
+		t.Error("lease key still set after Release")
+	}
+	if _, ok := tryLock(t, l, time.Minute); !ok {
+		t.Error("TryLock after Release: not acquired")
+	}
+}
+
+func TestRedisLockContention(t *testing.T) {
+	_, l := newTestRedisLocker(t)
+
+	if _, ok := tryLock(t, l, time.Minute); !ok {
+		t.Fatal("first TryLock: not acquired")
+	}
+	if lease, ok := tryLock(t, l, time.Minute); ok || lease != nil {
+		t.Errorf("second TryLock = %v, %v, want no lease while held", lease, ok)
+	}
+}
+
+func TestRedisLockExpiry(t *testing.T) {
+	mr, l := newTestRedisLocker(t)
+
+	if _, ok := tryLock(t, l, time.Minute); !ok {
+		t.Fatal("first TryLock: not acquired")
+	}
+	mr.FastForward(59 * time.Second)
+	if _, ok := tryLock(t, l, time.Minute); ok {
+		t.Fatal("TryLock before expiry: acquired")
+	}
+	mr.FastForward(2 * time.Second)
+	if _, ok := tryLock(t, l, time.Minute); !ok {
+		t.Error("TryLock after expiry: not acquired")
+	}
+}
+
+func TestRedisLockRenew(t *testing.T) {
+	mr, l := newTestRedisLocker(t)
+	ctx := context.Background()
+
+	lease, ok := tryLock(t, l, time.Minute)
+	if !ok {
+		t.Fatal("first TryLock: not acquired")
+	}
+	mr.FastForward(50 * time.Second)
+	if err := lease.Renew(ctx, time.Minute); err != nil {
+		t.Fatalf("Renew: %v", err)
+	}
+	mr.FastForward(50 * time.Second)
+	if _, ok := tryLock(t, l, time.Minute); ok {
+		t.Fatal("TryLock on a renewed lease: acquired")
+	}
+
+	mr.FastForward(time.Minute)
+	if _, ok := tryLock(t, l, time.Minute); !ok {
+		t.Fatal("TryLock after expiry: not acquired")
+	}
+	if err := lease.Renew(ctx, time.Minute); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("Renew of a lease taken over = %v, want ErrLeaseLost", err)
+	}
+}
+
+func TestRedisLockStaleRelease(t *testing.T) {
+	mr, l := newTestRedisLocker(t)
+	ctx := context.Background()
+
+	stale, ok := tryLock(t, l, time.Minute)
+	if !ok {
+		t.Fatal("first TryLock: not acquired")
+	}
+	mr.FastForward(2 * time.Minute)
+	current, ok := tryLock(t, l, time.Minute)
+	if !ok {
+		t.Fatal("TryLock after expiry: not acquired")
+	}
+
+	if err := stale.Release(ctx); err != nil {
+		t.Fatalf("Release of the stale lease: %v", err)
+	}
+	key := redisKeyPrefix + testLockName
+	if !mr.Exists(key) {
+		t.Fatal("stale Release deleted the new holder's lease")
+	}
+	if _, ok := tryLock(t, l, time.Minute); ok {
+		t.Error("TryLock after stale Release: acquired while the new holder has it")
+	}
+
+	if err := current.Release(ctx); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if mr.Exists(key) {
+		t.Error("lease key still set after the holder's Release")
+	}
+}
@@ -0,0 +1,300 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"golang.org/x/sync/errgroup"
+	"helm.sh/helm/v3/pkg/chart"
+)
+
+// ServeBlob serves the named blob from st. A missing blob is reported as
+// BLOB_UNKNOWN.
+func ServeBlob(w http.ResponseWriter, r *http.Request, st StorageBackend, name string) {
+	serveObject(w, r, st, name, ErrBlobUnknown)
+}
+
+// ServeManifest serves the manifest stored under name, which is either its
+// digest or a tag pointer. A missing manifest is reported as MANIFEST_UNKNOWN.
+func ServeManifest(w http.ResponseWriter, r *http.Request, st StorageBackend, name string) {
+	serveObject(w, r, st, name, ErrManifestUnknown)
+}
+
+// ServeImage writes config and layer blobs for the image, then writes and
+// serves the image manifest contents pointing to those blobs.
+func ServeImage(w http.ResponseWriter, r *http.Request, st StorageBackend, img v1.Image, also ...string) error {
+	if err := WriteImage(r.Context(), st, img, also...); err != nil {
+		return err
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+
+	// If it's just a HEAD request, serve that.
+	if r.Method == http.MethodHead {
+		mt, err := img.MediaType()
+		if err != nil {
+			return err
+		}
+		size, err := img.Size()
+		if err != nil {
+			return err
+		}
+		setHeaders(w, Descriptor{Digest: digest, MediaType: mt, Size: size})
+		return nil
+	}
+
+	ServeManifest(w, r, st, digest.String())
+	return nil
+}
+
+func serveObject(w http.ResponseWriter, r *http.Request, st StorageBackend, name string, unknown error) {
+	ctx := r.Context()
+
+	var (
+		content io.ReadSeeker
+		desc    Descriptor
+		err     error
+	)
+	if r.Method == http.MethodHead {
+		desc, err = st.Stat(ctx, name)
+		content = headContent(desc.Size)
+	} else {
+		var rc io.ReadSeekCloser
+		rc, desc, err = st.Open(ctx, name)
+		if err == nil {
+			defer rc.Close()
+			content = rc
+		}
+	}
+	if err != nil {
+		objectError(ctx, w, name, err, unknown)
+		return
+	}
+
+	setHeaders(w, desc)
+	if isDigest(name) {
+		// Digest-addressed content never changes.
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	// ServeContent takes care of Range, If-Range, If-None-Match and
+	// If-Modified-Since, and answers HEAD requests without reading content.
+	rec := &readErrRecorder{ReadSeeker: content}
+	http.ServeContent(w, r, "", desc.LastModified, rec)
+	if errors.Is(rec.err, ErrDigestMismatch) {
+		// Make sure the client sees a failed transfer rather than a
+		// response that merely ends early.
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// readErrRecorder remembers the first read error, which ServeContent drops.
+type readErrRecorder struct {
+	io.ReadSeeker
+	err error
+}
+
+func (r *readErrRecorder) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// headContent stands in for the object body when answering HEAD requests,
+// which only need its size.
+type headContent int64
+
+func (h headContent) Read([]byte) (int, error) {
+	return 0, errors.New("headContent: read on HEAD request")
+}
+
+func (h headContent) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekEnd {
+		return int64(h) + offset, nil
+	}
+	return offset, nil
+}
+
+func objectError(ctx context.Context, w http.ResponseWriter, name string, err, unknown error) {
+	if errors.Is(err, ErrBlobUnknown) {
+		Error(w, fmt.Errorf("%w: %s", unknown, name))
+		return
+	}
+	slog.ErrorContext(ctx, "Failed to get blob", "name", name, "error", err)
+	Error(w, &RegistryError{Code: "UNKNOWN", Status: http.StatusInternalServerError, Message: err.Error()})
+}
+
+func setHeaders(w http.ResponseWriter, desc Descriptor) {
+	if desc.MediaType != "" {
+		w.Header().Set("Content-Type", string(desc.MediaType))
+	}
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", desc.Size))
+	if desc.Digest != (v1.Hash{}) {
+		w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+		w.Header().Set("ETag", fmt.Sprintf("%q", desc.Digest.String()))
+	}
+}
+
+// isDigest reports whether name is a content digest rather than a tag pointer.
+func isDigest(name string) bool {
+	_, err := v1.NewHash(name)
+	return err == nil
+}
+
+// WriteImage writes the layer blobs, config blob and manifest to st. Blobs that
+// are already stored are skipped; the manifest is also written under each of
+// the names in also, replacing what was there.
+func WriteImage(ctx context.Context, st StorageBackend, img v1.Image, also ...string) error {
+	// Write config blob for later serving.
+	ch, err := img.ConfigName()
+	if err != nil {
+		return err
+	}
+	cb, err := img.RawConfigFile()
+	if err != nil {
+		return err
+	}
+	cdesc := Descriptor{Digest: ch, MediaType: "application/json", Size: int64(len(cb))}
+	if err := putBlob(ctx, st, cdesc, func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(cb)), nil
+	}); err != nil {
+		return err
+	}
+
+	// Write layer blobs for later serving.
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	var g errgroup.Group
+	for _, l := range layers {
+		g.Go(func() error {
+			lh, err := l.Digest()
+			if err != nil {
+				return err
+			}
+			mt, err := l.MediaType()
+			if err != nil {
+				return err
+			}
+			size, err := l.Size()
+			if err != nil {
+				return err
+			}
+			return putBlob(ctx, st, Descriptor{Digest: lh, MediaType: mt, Size: size}, l.Compressed)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	// Write the manifest as a blob.
+	b, err := img.RawManifest()
+	if err != nil {
+		return err
+	}
+	mt, err := img.MediaType()
+	if err != nil {
+		return err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	mdesc := Descriptor{Digest: digest, MediaType: mt, Size: int64(len(b))}
+	if err := putBlob(ctx, st, mdesc, func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}); err != nil {
+		return err
+	}
+	for _, a := range also {
+		g.Go(func() error {
+			return st.Put(ctx, a, mdesc, bytes.NewReader(b))
+		})
+	}
+	return g.Wait()
+}
+
+// BlobTouchInterval is how old a stored blob may be before a build that
+// reuses it writes it again. Rewriting refreshes its modification time, so
+// that the grace period of GarbageCollect keeps it until the tag pointer
+// referencing it is written.
+const BlobTouchInterval = time.Hour
+
+// putBlob writes a digest-addressed blob unless it is already stored, and
+// was written recently enough to be protected from garbage collection.
+func putBlob(ctx context.Context, st StorageBackend, desc Descriptor, open func() (io.ReadCloser, error)) error {
+	if held, err := st.Stat(ctx, desc.Digest.String()); err == nil {
+		if held.LastModified.IsZero() || time.Since(held.LastModified) < BlobTouchInterval {
+			return nil
+		}
+	} else if !errors.Is(err, ErrBlobUnknown) {
+		return err
+	}
+
+	rc, err := open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return st.Put(ctx, desc.Digest.String(), desc, rc)
+}
+
+// ReadManifest reads and parses the manifest stored under name.
+func ReadManifest(ctx context.Context, st StorageBackend, name string) (*v1.Manifest, Descriptor, error) {
+	rc, desc, err := st.Open(ctx, name)
+	if err != nil {
+		return nil, Descriptor{}, err
+	}
+	defer rc.Close()
+
+	m, err := v1.ParseManifest(rc)
+	if err != nil {
+		return nil, Descriptor{}, fmt.Errorf("failed to parse manifest %s: %w", name, err)
+	}
+	return m, desc, nil
+}
+
+// ReadChartMetadata reads the chart metadata of the manifest stored under
+// name. The proxy stores it as the first layer, with the config media type;
+// for other manifests the config blob is read.
+func ReadChartMetadata(ctx context.Context, st StorageBackend, name string) (*chart.Metadata, error) {
+	m, _, err := ReadManifest(ctx, st, name)
+	if err != nil {
+		return nil, err
+	}
+	rc, _, err := st.Open(ctx, ChartMetadataDigest(m).String())
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var md chart.Metadata
+	if err := json.NewDecoder(io.LimitReader(rc, 1<<20)).Decode(&md); err != nil {
+		return nil, fmt.Errorf("failed to parse chart metadata of %s: %w", name, err)
+	}
+	return &md, nil
+}
+
+// ChartMetadataDigest returns the digest of the blob holding the chart
+// metadata of m.
+func ChartMetadataDigest(m *v1.Manifest) v1.Hash {
+	for _, l := range m.Layers {
+		if l.MediaType == m.Config.MediaType {
+			return l.Digest
+		}
+	}
+	return m.Config.Digest
+}
@@ -0,0 +1,579 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tuananh/helm-oci-proxy/pkg/types"
+)
+
+func init() {
+	RegisterBackend("replicated", NewReplicatedStorage)
+}
+
+// defaultRetryAfter is how long a failed replica is skipped by reads before
+// it is tried again.
+const defaultRetryAfter = 30 * time.Second
+
+// repairQueueSize bounds the blob repairs waiting to be done in the
+// background. Repairs found while the queue is full are dropped and left to
+// resync.
+const repairQueueSize = 64
+
+// ReplicatedStorage implements the StorageBackend interface on top of several
+// backends. Writes go to all of them and succeed once a quorum has the
+// object, reads go to the first healthy backend that has it.
+//
+// Conditional writes are decided by a fixed replica, the coordinator: the
+// first one, in config order, that can create objects conditionally. Proxy
+// instances may disagree about which replicas are healthy, so picking a
+// healthy one could let two of them win the same lease on different
+// replicas. Leases are only kept on the coordinator; they don't survive
+// losing it, and can't be taken while it is down.
+type ReplicatedStorage struct {
+	replicas    []*replica
+	coordinator *replica
+	quorum      int
+	retryAfter  time.Duration
+
+	repairOnce sync.Once
+	repairs    chan blobRepair
+	mu         sync.Mutex
+	queued     map[blobRepair]bool
+}
+
+// blobRepair is a blob to copy from one replica to another that misses it.
+type blobRepair struct {
+	name     string
+	from, to *replica
+}
+
+// replicatedOptions are the storage options of the replicated backend
+type replicatedOptions struct {
+	Backends   []types.StorageConfig `yaml:"backends"`   // Replicas, in read preference order
+	Quorum     int                   `yaml:"quorum"`     // Writes needed for success, defaults to all
+	RetryAfter time.Duration         `yaml:"retryAfter"` // How long reads skip a failed replica
+}
+
+// replica is one backend of a ReplicatedStorage along with its health.
+type replica struct {
+	name string
+	StorageBackend
+
+	mu       sync.Mutex
+	failedAt time.Time
+}
+
+// NewReplicatedStorage creates a new ReplicatedStorage instance. The replicas
+// store objects under the keys of the replicated storage itself; their own
+// prefix, layout, cache and verification settings are not used.
+func NewReplicatedStorage(ctx context.Context, config types.StorageConfig) (StorageBackend, error) {
+	var opts replicatedOptions
+	if err := config.Decode(&opts); err != nil {
+		return nil, fmt.Errorf("invalid replicated storage options: %w", err)
+	}
+	if len(opts.Backends) == 0 {
+		return nil, fmt.Errorf("backends are required for replicated storage")
+	}
+	if opts.Quorum == 0 {
+		opts.Quorum = len(opts.Backends)
+	}
+	if opts.Quorum < 1 || opts.Quorum > len(opts.Backends) {
+		return nil, fmt.Errorf("quorum must be between 1 and %d", len(opts.Backends))
+	}
+	if opts.RetryAfter == 0 {
+		opts.RetryAfter = defaultRetryAfter
+	}
+
+	s := &ReplicatedStorage{quorum: opts.Quorum, retryAfter: opts.RetryAfter, queued: map[blobRepair]bool{}}
+	for i, bc := range opts.Backends {
+		st, err := NewBackend(ctx, bc)
+		if err != nil {
+			return nil, fmt.Errorf("replica %d: %w", i, err)
+		}
+		r := &replica{name: replicaName(i, bc), StorageBackend: st}
+		if _, ok := st.(Creator); ok && s.coordinator == nil {
+			s.coordinator = r
+		}
+		s.replicas = append(s.replicas, r)
+	}
+	return s, nil
+}
+
+// replicaName identifies a replica in logs and errors.
+func replicaName(i int, config types.StorageConfig) string {
+	if config.Bucket != "" {
+		return fmt.Sprintf("%d (%s:%s)", i, config.Type, config.Bucket)
+	}
+	return fmt.Sprintf("%d (%s)", i, config.Type)
+}
+
+// Replicas returns the number of replicas.
+func (s *ReplicatedStorage) Replicas() int {
+	return len(s.replicas)
+}
+
+// Open opens the object from the first healthy replica that has it. Leases
+// are read from the coordinator.
+func (s *ReplicatedStorage) Open(ctx context.Context, name string) (io.ReadSeekCloser, Descriptor, error) {
+	if isLockKey(name) && s.coordinator != nil {
+		return s.coordinator.Open(ctx, name)
+	}
+	var (
+		rc   io.ReadSeekCloser
+		desc Descriptor
+	)
+	err := s.read(ctx, name, func(r *replica) (err error) {
+		rc, desc, err = r.Open(ctx, name)
+		desc.Version = s.version(r, desc)
+		return err
+	})
+	return rc, desc, err
+}
+
+// Stat returns the descriptor from the first healthy replica that has the
+// object. Blobs are looked up on every healthy replica, and queued to be
+// copied to those missing them: writers skip blobs that are found, so a
+// replica that missed one would otherwise never get it.
+func (s *ReplicatedStorage) Stat(ctx context.Context, name string) (Descriptor, error) {
+	if isLockKey(name) && s.coordinator != nil {
+		return s.coordinator.Stat(ctx, name)
+	}
+	if isBlobKey(name) {
+		return s.statBlob(ctx, name)
+	}
+	var desc Descriptor
+	err := s.read(ctx, name, func(r *replica) (err error) {
+		desc, err = r.Stat(ctx, name)
+		desc.Version = s.version(r, desc)
+		return err
+	})
+	return desc, err
+}
+
+// version returns the version of an object read from r. Versions are only
+// used for conditional writes, which go to the coordinator, so those of the
+// other replicas are dropped; writers then fall back to plain writes.
+func (s *ReplicatedStorage) version(r *replica, desc Descriptor) string {
+	if r != s.coordinator {
+		return ""
+	}
+	return desc.Version
+}
+
+// statBlob returns the descriptor of a blob from the first replica that has
+// it, and repairs the healthy replicas that don't.
+func (s *ReplicatedStorage) statBlob(ctx context.Context, name string) (Descriptor, error) {
+	var (
+		from    *replica
+		desc    Descriptor
+		missing []*replica
+		errs    []error
+	)
+	for _, r := range s.ordered() {
+		healthy := r.healthy(s.retryAfter)
+		if !healthy && from != nil {
+			break
+		}
+		d, err := r.Stat(ctx, name)
+		switch {
+		case err == nil:
+			r.succeeded()
+			if from == nil {
+				from, desc = r, d
+			}
+		case errors.Is(err, ErrBlobUnknown):
+			if healthy {
+				missing = append(missing, r)
+			}
+		case ctx.Err() != nil:
+			return Descriptor{}, ctx.Err()
+		default:
+			r.failed(ctx, err)
+			errs = append(errs, fmt.Errorf("replica %s: %w", r.name, err))
+		}
+	}
+	if from == nil {
+		if len(missing) > 0 {
+			return Descriptor{}, fmt.Errorf("%w: %s", ErrBlobUnknown, name)
+		}
+		return Descriptor{}, errors.Join(errs...)
+	}
+	for _, r := range missing {
+		s.queueRepair(ctx, blobRepair{name: name, from: from, to: r})
+	}
+	desc.Version = s.version(from, desc)
+	return desc, nil
+}
+
+// queueRepair hands a blob repair to the background worker, which copies
+// blobs one at a time so that lookups never wait for a copy.
+func (s *ReplicatedStorage) queueRepair(ctx context.Context, job blobRepair) {
+	s.repairOnce.Do(func() {
+		s.repairs = make(chan blobRepair, repairQueueSize)
+		go s.repairLoop(context.WithoutCancel(ctx))
+	})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queued[job] {
+		return
+	}
+	select {
+	case s.repairs <- job:
+		s.queued[job] = true
+	default:
+		slog.WarnContext(ctx, "repair queue full, resync the replica to repair it", "replica", job.to.name, "name", job.name)
+	}
+}
+
+func (s *ReplicatedStorage) repairLoop(ctx context.Context) {
+	for job := range s.repairs {
+		s.repair(ctx, job)
+		s.mu.Lock()
+		delete(s.queued, job)
+		s.mu.Unlock()
+	}
+}
+
+// repair copies a blob to a replica that misses it, unless it was written
+// there, or deleted, e.g. by gc, since it was found missing. Failures are
+// logged: the blob can still be read from the others.
+func (s *ReplicatedStorage) repair(ctx context.Context, job blobRepair) {
+	if _, err := job.to.Stat(ctx, job.name); !errors.Is(err, ErrBlobUnknown) {
+		return
+	}
+	rc, desc, err := job.from.Open(ctx, job.name)
+	if errors.Is(err, ErrBlobUnknown) {
+		return
+	} else if err != nil {
+		slog.WarnContext(ctx, "failed to repair replica", "replica", job.to.name, "name", job.name, "err", err)
+		return
+	}
+	defer rc.Close()
+	if err := job.to.Put(ctx, job.name, desc, rc); err != nil {
+		job.to.failed(ctx, err)
+		return
+	}
+	slog.InfoContext(ctx, "repaired replica", "replica", job.to.name, "name", job.name)
+}
+
+// isBlobKey reports whether key is the bucket key of a digest-addressed blob.
+func isBlobKey(key string) bool {
+	dir, name := path.Split(key)
+	return isDigest(name) && (dir == "blobs/" || strings.HasSuffix(dir, "/blobs/"))
+}
+
+// isLockKey reports whether key is the bucket key of a lease.
+func isLockKey(key string) bool {
+	return objectKind(key) == "locks"
+}
+
+// read calls fn for the healthy replicas in order until one succeeds. A
+// replica that misses the object, for instance because it was down when the
+// object was written, falls through to the next one. Failed replicas are
+// only tried when no healthy one is left.
+func (s *ReplicatedStorage) read(ctx context.Context, name string, fn func(r *replica) error) error {
+	var errs []error
+	unknown := 0
+	for _, r := range s.ordered() {
+		err := fn(r)
+		switch {
+		case err == nil:
+			r.succeeded()
+			return nil
+		case errors.Is(err, ErrBlobUnknown):
+			unknown++
+		case ctx.Err() != nil:
+			return ctx.Err()
+		default:
+			r.failed(ctx, err)
+			errs = append(errs, fmt.Errorf("replica %s: %w", r.name, err))
+		}
+	}
+	if unknown > 0 {
+		return fmt.Errorf("%w: %s", ErrBlobUnknown, name)
+	}
+	return errors.Join(errs...)
+}
+
+// ordered returns the healthy replicas followed by the failed ones.
+func (s *ReplicatedStorage) ordered() []*replica {
+	healthy := make([]*replica, 0, len(s.replicas))
+	var failed []*replica
+	for _, r := range s.replicas {
+		if r.healthy(s.retryAfter) {
+			healthy = append(healthy, r)
+		} else {
+			failed = append(failed, r)
+		}
+	}
+	return append(healthy, failed...)
+}
+
+// Put writes the object to all replicas. The content is spooled to a
+// temporary file first so that every replica can read it at its own pace.
+func (s *ReplicatedStorage) Put(ctx context.Context, name string, desc Descriptor, r io.Reader) error {
+	f, err := os.CreateTemp("", "helm-oci-proxy-replicated-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	n, err := io.Copy(f, r)
+	if err != nil {
+		return fmt.Errorf("copy: %w", err)
+	}
+	return s.write(ctx, name, "write", func(r *replica) error {
+		return r.Put(ctx, name, desc, io.NewSectionReader(f, 0, n))
+	})
+}
+
+// Create creates the object on the coordinator. Such objects are meant for
+// coordination between proxy instances and are not replicated.
+func (s *ReplicatedStorage) Create(ctx context.Context, name string, desc Descriptor, r io.Reader) error {
+	return s.decide(ctx, "create", func(c *replica) error {
+		return Create(ctx, c.StorageBackend, name, desc, r)
+	})
+}
+
+// Replace replaces the object on the coordinator, which decides like for
+// Create, then writes it to the other replicas unless it is a lease.
+func (s *ReplicatedStorage) Replace(ctx context.Context, name, version string, desc Descriptor, r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("copy: %w", err)
+	}
+	if err := s.decide(ctx, "replace", func(c *replica) error {
+		return Replace(ctx, c.StorageBackend, name, version, desc, bytes.NewReader(b))
+	}); err != nil {
+		return err
+	}
+	if !isLockKey(name) {
+		s.propagate(ctx, func(r *replica) error {
+			return r.Put(ctx, name, desc, bytes.NewReader(b))
+		})
+	}
+	return nil
+}
+
+// DeleteVersion deletes the object from the coordinator, which decides like
+// for Create, then from the other replicas unless it is a lease.
+func (s *ReplicatedStorage) DeleteVersion(ctx context.Context, name, version string) error {
+	if err := s.decide(ctx, "delete", func(c *replica) error {
+		return DeleteVersion(ctx, c.StorageBackend, name, version)
+	}); err != nil {
+		return err
+	}
+	if !isLockKey(name) {
+		s.propagate(ctx, func(r *replica) error {
+			return r.Delete(ctx, name)
+		})
+	}
+	return nil
+}
+
+// decide calls fn for the coordinator. A failed condition is an answer, not
+// a failure, and is returned as is. There is no fallback to another
+// replica, which could decide differently.
+func (s *ReplicatedStorage) decide(ctx context.Context, op string, fn func(c *replica) error) error {
+	c := s.coordinator
+	if c == nil {
+		return fmt.Errorf("no replica can %s objects conditionally: %w", op, errors.ErrUnsupported)
+	}
+	err := fn(c)
+	switch {
+	case err == nil, errors.Is(err, ErrObjectExists), errors.Is(err, ErrObjectChanged):
+		c.succeeded()
+		return err
+	case errors.Is(err, errors.ErrUnsupported), ctx.Err() != nil:
+		return err
+	}
+	c.failed(ctx, err)
+	return fmt.Errorf("replica %s: %w", c.name, err)
+}
+
+// propagate calls fn for the replicas other than the coordinator, once a
+// conditional write succeeded on it. The write has happened, so failures
+// only leave the replicas out of sync.
+func (s *ReplicatedStorage) propagate(ctx context.Context, fn func(r *replica) error) {
+	for _, r := range s.replicas {
+		if r == s.coordinator {
+			continue
+		}
+		if err := fn(r); err != nil {
+			r.failed(ctx, err)
+			slog.WarnContext(ctx, "replica out of sync, resync it once it is back", "replica", r.name, "err", err)
+		}
+	}
+}
+
+// Delete removes the object from all replicas
+func (s *ReplicatedStorage) Delete(ctx context.Context, name string) error {
+	return s.write(ctx, name, "delete", func(r *replica) error {
+		return r.Delete(ctx, name)
+	})
+}
+
+// write calls fn for all replicas concurrently. It fails unless at least
+// quorum of them succeed; replicas that failed are left behind and need a
+// resync once they are back.
+func (s *ReplicatedStorage) write(ctx context.Context, name, op string, fn func(r *replica) error) error {
+	errs := make([]error, len(s.replicas))
+	var wg sync.WaitGroup
+	for i, r := range s.replicas {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(r)
+		}()
+	}
+	wg.Wait()
+
+	ok := 0
+	for i, r := range s.replicas {
+		if errs[i] == nil {
+			r.succeeded()
+			ok++
+			continue
+		}
+		r.failed(ctx, errs[i])
+		errs[i] = fmt.Errorf("replica %s: %w", r.name, errs[i])
+	}
+	if ok < s.quorum {
+		return fmt.Errorf("failed to %s %s on %d of %d replicas (quorum %d): %w",
+			op, name, len(s.replicas)-ok, len(s.replicas), s.quorum, errors.Join(errs...))
+	}
+	if ok < len(s.replicas) {
+		slog.WarnContext(ctx, "replica out of sync, resync it once it is back",
+			"op", op, "name", name, "err", errors.Join(errs...))
+	}
+	return nil
+}
+
+// List calls fn once for every name held by any replica. Replicas that fail
+// to list are skipped as long as one of them succeeds.
+func (s *ReplicatedStorage) List(ctx context.Context, prefix string, fn func(name string) error) error {
+	seen := map[string]bool{}
+	var (
+		errs   []error
+		listed bool
+		ferr   error
+	)
+	for _, r := range s.ordered() {
+		err := r.List(ctx, prefix, func(name string) error {
+			if seen[name] {
+				return nil
+			}
+			seen[name] = true
+			ferr = fn(name)
+			return ferr
+		})
+		if ferr != nil {
+			return ferr
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			r.failed(ctx, err)
+			errs = append(errs, fmt.Errorf("replica %s: %w", r.name, err))
+			continue
+		}
+		r.succeeded()
+		listed = true
+	}
+	if !listed {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// Resync makes replica i a mirror of replica from: it copies everything
+// from holds that i is missing or holds an outdated copy of, and deletes
+// what only i holds, such as objects deleted while it was down. Leases are
+// not replicated and are left alone. Only names starting with opts.Prefix
+// are synced.
+func (s *ReplicatedStorage) Resync(ctx context.Context, i, from int, opts CopyOptions) (CopyResult, error) {
+	for _, j := range []int{i, from} {
+		if j < 0 || j >= len(s.replicas) {
+			return CopyResult{}, fmt.Errorf("no replica %d, have %d", j, len(s.replicas))
+		}
+	}
+	if i == from {
+		return CopyResult{}, fmt.Errorf("can't resync replica %d from itself", i)
+	}
+	src, dst := s.replicas[from], s.replicas[i]
+
+	res, err := Copy(ctx, src.StorageBackend, dst.StorageBackend, opts)
+	if err != nil {
+		return res, err
+	}
+
+	held := map[string]bool{}
+	if err := src.List(ctx, opts.Prefix, func(name string) error {
+		held[name] = true
+		return nil
+	}); err != nil {
+		return res, fmt.Errorf("replica %s: %w", src.name, err)
+	}
+	var extra []string
+	if err := dst.List(ctx, opts.Prefix, func(name string) error {
+		if !held[name] && !isLockKey(name) {
+			extra = append(extra, name)
+		}
+		return nil
+	}); err != nil {
+		return res, fmt.Errorf("replica %s: %w", dst.name, err)
+	}
+	for _, name := range extra {
+		// Written since the source was listed.
+		if _, err := src.Stat(ctx, name); err == nil {
+			continue
+		} else if !errors.Is(err, ErrBlobUnknown) {
+			return res, fmt.Errorf("replica %s: %w", src.name, err)
+		}
+		slog.InfoContext(ctx, "delete", "name", name, "dryRun", opts.DryRun)
+		if !opts.DryRun {
+			if err := dst.Delete(ctx, name); err != nil {
+				return res, fmt.Errorf("replica %s: %w", dst.name, err)
+			}
+		}
+		res.Deleted++
+	}
+	dst.succeeded()
+	return res, nil
+}
+
+func (r *replica) healthy(retryAfter time.Duration) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.failedAt.IsZero() || time.Since(r.failedAt) > retryAfter
+}
+
+func (r *replica) succeeded() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.failedAt.IsZero() {
+		slog.Info("replica recovered", "replica", r.name)
+	}
+	r.failedAt = time.Time{}
+}
+
+func (r *replica) failed(ctx context.Context, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failedAt.IsZero() {
+		slog.ErrorContext(ctx, "replica failed", "replica", r.name, "err", err)
+	}
+	r.failedAt = time.Now()
+}
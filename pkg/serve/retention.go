@@ -0,0 +1,241 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/tuananh/helm-oci-proxy/pkg/types"
+)
+
+// AccessName returns the name of the object recording when the tag pointer
+// tagName was last pulled.
+func AccessName(tagName string) string {
+	ns, key, _ := strings.Cut(tagName, "/tags/")
+	return ns + "/access/" + key
+}
+
+// AccessLog records when tag pointers are pulled. To keep pulls cheap, each
+// pointer is written at most once per interval by this process.
+type AccessLog struct {
+	st       StorageBackend
+	interval time.Duration
+
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// NewAccessLog returns an AccessLog that records pulls in st.
+func NewAccessLog(st StorageBackend, interval time.Duration) *AccessLog {
+	return &AccessLog{st: st, interval: interval, last: map[string]time.Time{}}
+}
+
+// Touch records that tagName was pulled now. The write happens in the
+// background and failures are only logged.
+func (a *AccessLog) Touch(ctx context.Context, tagName string) {
+	now := time.Now().UTC()
+
+	a.mu.Lock()
+	if now.Sub(a.last[tagName]) < a.interval {
+		a.mu.Unlock()
+		return
+	}
+	a.last[tagName] = now
+	a.mu.Unlock()
+
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		ts := now.Format(time.RFC3339)
+		desc := Descriptor{MediaType: "text/plain", Size: int64(len(ts))}
+		if err := a.st.Put(ctx, AccessName(tagName), desc, strings.NewReader(ts)); err != nil {
+			slog.WarnContext(ctx, "failed to record access", "name", tagName, "err", err)
+		}
+		if err := touchIndexEntry(ctx, a.st, tagName, now); err != nil {
+			slog.WarnContext(ctx, "failed to record access in index", "name", tagName, "err", err)
+		}
+	}()
+}
+
+// LastAccess returns when tagName was last pulled, falling back to when the
+// pointer was written if no pull was recorded.
+func LastAccess(ctx context.Context, st StorageBackend, tagName string) (time.Time, error) {
+	rc, _, err := st.Open(ctx, AccessName(tagName))
+	if err == nil {
+		defer rc.Close()
+		b, err := io.ReadAll(io.LimitReader(rc, 64))
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Parse(time.RFC3339, strings.TrimSpace(string(b)))
+	}
+	if !errors.Is(err, ErrBlobUnknown) {
+		return time.Time{}, err
+	}
+
+	desc, err := st.Stat(ctx, tagName)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return desc.LastModified, nil
+}
+
+// RetentionDecision is the outcome of the retention policy for one cached
+// chart version.
+type RetentionDecision struct {
+	TagName    string
+	Chart      string
+	Version    string
+	LastAccess time.Time
+	Keep       bool
+	Reason     string
+}
+
+// ApplyRetention applies the retention policy of a repository to the tag
+// pointers of its namespace. A version is kept if it is pinned, is one of the
+// newest KeepLast versions of its chart, or was pulled within MaxIdle; every
+// other version is removed. Pointers to the same version, such as a legacy
+// pointer next to the one that replaced it, count as one version and share
+// its decision. Removing a tag pointer leaves its blobs to gc.
+func ApplyRetention(ctx context.Context, st StorageBackend, namespace string, policy types.RetentionConfig, dryRun bool) ([]RetentionDecision, error) {
+	now := time.Now()
+
+	type chartVersion struct{ chart, version string }
+	pointers := map[chartVersion][]RetentionDecision{}
+	if err := st.List(ctx, namespace+"/tags/", func(name string) error {
+		d, err := retentionCandidate(ctx, st, name)
+		if errors.Is(err, ErrBlobUnknown) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		k := chartVersion{d.Chart, d.Version}
+		pointers[k] = append(pointers[k], d)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to list tag pointers of %s: %w", namespace, err)
+	}
+
+	// A version was last pulled when any of its pointers was.
+	charts := map[string][]RetentionDecision{}
+	for k, ds := range pointers {
+		v := ds[0]
+		for _, d := range ds[1:] {
+			if d.LastAccess.After(v.LastAccess) {
+				v.LastAccess = d.LastAccess
+			}
+		}
+		charts[k.chart] = append(charts[k.chart], v)
+	}
+
+	var decisions []RetentionDecision
+	for _, versions := range charts {
+		sortVersions(versions)
+		for i, v := range versions {
+			keep, reason := retain(policy, now, i, v)
+			for _, d := range pointers[chartVersion{v.Chart, v.Version}] {
+				d.LastAccess, d.Keep, d.Reason = v.LastAccess, keep, reason
+				decisions = append(decisions, d)
+			}
+		}
+	}
+	sort.Slice(decisions, func(i, j int) bool { return decisions[i].TagName < decisions[j].TagName })
+
+	if dryRun {
+		return decisions, nil
+	}
+	for _, d := range decisions {
+		if d.Keep {
+			continue
+		}
+		if err := st.Delete(ctx, d.TagName); err != nil {
+			return decisions, err
+		}
+		if err := st.Delete(ctx, AccessName(d.TagName)); err != nil {
+			return decisions, err
+		}
+		if err := st.Delete(ctx, IndexName(d.TagName)); err != nil {
+			return decisions, err
+		}
+	}
+	return decisions, nil
+}
+
+// retain decides whether policy keeps version v, the rank-th newest version
+// of its chart.
+func retain(policy types.RetentionConfig, now time.Time, rank int, v RetentionDecision) (bool, string) {
+	switch {
+	case pinned(policy.Pin, v.Chart, v.Version):
+		return true, "pinned"
+	case policy.KeepLast > 0 && rank < policy.KeepLast:
+		return true, fmt.Sprintf("one of the last %d versions", policy.KeepLast)
+	case policy.MaxIdle > 0 && now.Sub(v.LastAccess) < policy.MaxIdle:
+		return true, "pulled recently"
+	case policy.KeepLast == 0 && policy.MaxIdle == 0:
+		return true, "no retention rule"
+	default:
+		return false, "expired"
+	}
+}
+
+// retentionCandidate describes the chart version behind a tag pointer, from
+// its index entry if it has one, or else from its manifest.
+func retentionCandidate(ctx context.Context, st StorageBackend, tagName string) (RetentionDecision, error) {
+	if e, err := ReadIndexEntry(ctx, st, tagName); err == nil {
+		last := e.LastPulled
+		if last.IsZero() {
+			last = e.BuiltAt
+		}
+		return RetentionDecision{TagName: tagName, Chart: e.Chart, Version: e.Version, LastAccess: last}, nil
+	} else if !errors.Is(err, ErrBlobUnknown) {
+		return RetentionDecision{}, err
+	}
+
+	md, err := ReadChartMetadata(ctx, st, tagName)
+	if err != nil {
+		return RetentionDecision{}, err
+	}
+	last, err := LastAccess(ctx, st, tagName)
+	if err != nil {
+		return RetentionDecision{}, err
+	}
+	return RetentionDecision{TagName: tagName, Chart: md.Name, Version: md.Version, LastAccess: last}, nil
+}
+
+// sortVersions sorts newest first. Versions that are not valid semver sort
+// after the valid ones.
+func sortVersions(ds []RetentionDecision) {
+	sort.SliceStable(ds, func(i, j int) bool {
+		vi, erri := semver.NewVersion(ds[i].Version)
+		vj, errj := semver.NewVersion(ds[j].Version)
+		switch {
+		case erri == nil && errj == nil:
+			return vi.GreaterThan(vj)
+		case erri == nil || errj == nil:
+			return erri == nil
+		default:
+			return ds[i].Version > ds[j].Version
+		}
+	})
+}
+
+// pinned reports whether version matches one of the pin patterns. Patterns
+// are globs matched against the version, or against "<chart>:<version>".
+func pinned(pins []string, chart, version string) bool {
+	for _, p := range pins {
+		if ok, _ := path.Match(p, version); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, chart+":"+version); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tuananh/helm-oci-proxy/pkg/types"
+)
+
+func TestRetain(t *testing.T) {
+	now := time.Now()
+	v := func(chart, version string, idle time.Duration) RetentionDecision {
+		return RetentionDecision{Chart: chart, Version: version, LastAccess: now.Add(-idle)}
+	}
+	tests := []struct {
+		name   string
+		policy types.RetentionConfig
+		rank   int
+		v      RetentionDecision
+		want   bool
+	}{
+		{"no rule", types.RetentionConfig{}, 10, v("argo-cd", "1.0.0", 1000*time.Hour), true},
+		{"within keepLast", types.RetentionConfig{KeepLast: 2}, 1, v("argo-cd", "1.0.0", 1000*time.Hour), true},
+		{"past keepLast", types.RetentionConfig{KeepLast: 2}, 2, v("argo-cd", "1.0.0", 0), false},
+		{"pulled recently", types.RetentionConfig{MaxIdle: time.Hour}, 10, v("argo-cd", "1.0.0", time.Minute), true},
+		{"idle", types.RetentionConfig{MaxIdle: time.Hour}, 0, v("argo-cd", "1.0.0", 2*time.Hour), false},
+		{"either rule keeps", types.RetentionConfig{KeepLast: 1, MaxIdle: time.Hour}, 5, v("argo-cd", "1.0.0", time.Minute), true},
+		{"both rules expire", types.RetentionConfig{KeepLast: 1, MaxIdle: time.Hour}, 5, v("argo-cd", "1.0.0", 2*time.Hour), false},
+		{"pinned version", types.RetentionConfig{KeepLast: 1, Pin: []string{"1.2.*"}}, 5, v("argo-cd", "1.2.3", 0), true},
+		{"pinned chart version", types.RetentionConfig{KeepLast: 1, Pin: []string{"argo-cd:1.*"}}, 5, v("argo-cd", "1.2.3", 0), true},
+		{"pin of another chart", types.RetentionConfig{KeepLast: 1, Pin: []string{"redis:1.*"}}, 5, v("argo-cd", "1.2.3", 0), false},
+		{"pin of another version", types.RetentionConfig{KeepLast: 1, Pin: []string{"1.3.*"}}, 5, v("argo-cd", "1.2.3", 0), false},
+	}
+	for _, tt := range tests {
+		if got, reason := retain(tt.policy, now, tt.rank, tt.v); got != tt.want {
+			t.Errorf("%s: retain = %v (%s), want %v", tt.name, got, reason, tt.want)
+		}
+	}
+}
+
+func TestSortVersions(t *testing.T) {
+	ds := []RetentionDecision{{Version: "1.2.0"}, {Version: "latest"}, {Version: "1.10.0"}, {Version: "1.10.0-rc.1"}, {Version: "0.9.1"}, {Version: "edge"}}
+	sortVersions(ds)
+	want := []string{"1.10.0", "1.10.0-rc.1", "1.2.0", "0.9.1", "latest", "edge"}
+	for i, d := range ds {
+		if d.Version != want[i] {
+			t.Fatalf("sorted versions = %v, want %v", ds, want)
+		}
+	}
+}
+
+func TestApplyRetention(t *testing.T) {
+	ctx := context.Background()
+	st := newTestLocalStorage(t)
+	now := time.Now().UTC()
+	pointer := func(tagName, chart, version string, idle time.Duration) {
+		t.Helper()
+		if err := st.Put(ctx, tagName, Descriptor{}, bytes.NewReader([]byte("{}"))); err != nil {
+			t.Fatal(err)
+		}
+		e := IndexEntry{TagName: tagName, Namespace: "argo", Chart: chart, Version: version, BuiltAt: now.Add(-idle)}
+		if err := PutIndexEntry(ctx, st, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pointer("argo/tags/up/argo-cd/1.0.0", "argo-cd", "1.0.0", 100*time.Hour)
+	pointer("argo/tags/up/argo-cd/1.1.0", "argo-cd", "1.1.0", 100*time.Hour)
+	pointer("argo/tags/up/argo-cd/1.2.0", "argo-cd", "1.2.0", 100*time.Hour)
+	pointer("argo/tags/up/argo-cd/1.3.0", "argo-cd", "1.3.0", 100*time.Hour)
+	pointer("argo/tags/up/redis/0.1.0", "redis", "0.1.0", 100*time.Hour)
+	// Legacy pointers next to their replacements: 1.3.0 must count once
+	// towards keepLast, and 1.1.0 was pulled recently through its old one.
+	pointer("argo/tags/helm-oci-proxy-13", "argo-cd", "1.3.0", 100*time.Hour)
+	pointer("argo/tags/helm-oci-proxy-11", "argo-cd", "1.1.0", time.Minute)
+
+	policy := types.RetentionConfig{KeepLast: 2, MaxIdle: time.Hour}
+	decisions, err := ApplyRetention(ctx, st, "argo", policy, false)
+	if err != nil {
+		t.Fatalf("ApplyRetention: %v", err)
+	}
+
+	want := map[string]bool{
+		"argo/tags/helm-oci-proxy-11": true,
+		"argo/tags/helm-oci-proxy-13": true,
+		"argo/tags/up/argo-cd/1.0.0":  false,
+		"argo/tags/up/argo-cd/1.1.0":  true,
+		"argo/tags/up/argo-cd/1.2.0":  true,
+		"argo/tags/up/argo-cd/1.3.0":  true,
+		"argo/tags/up/redis/0.1.0":    true,
+	}
+	if len(decisions) != len(want) {
+		t.Errorf("got %d decisions, want %d", len(decisions), len(want))
+	}
+	for _, d := range decisions {
+		if keep, ok := want[d.TagName]; !ok || d.Keep != keep {
+			t.Errorf("%s: keep = %v (%s), want %v", d.TagName, d.Keep, d.Reason, keep)
+		}
+		if d.Version == "1.1.0" && now.Sub(d.LastAccess) > time.Hour {
+			t.Errorf("%s: last access = %v, want that of the legacy pointer", d.TagName, d.LastAccess)
+		}
+	}
+	for name, keep := range want {
+		if got := exists(t, st, name); got != keep {
+			t.Errorf("%s exists = %v, want %v", name, got, keep)
+		}
+		if got := exists(t, st, IndexName(name)); got != keep {
+			t.Errorf("index entry of %s exists = %v, want %v", name, got, keep)
+		}
+	}
+}
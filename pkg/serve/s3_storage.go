@@ -3,19 +3,21 @@ package serve
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"net/http"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	ocitypes "github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/tuananh/helm-oci-proxy/pkg/types"
-	"golang.org/x/sync/errgroup"
 )
 
 // S3Storage implements the StorageBackend interface for S3
@@ -24,10 +26,15 @@ type S3Storage struct {
 	endpoint string
 	region   string
 	client   *s3.S3
+	uploader *s3manager.Uploader
 }
 
-// New creates a new S3Storage instance
-func (s *S3Storage) New(ctx context.Context, config types.StorageConfig) (StorageBackend, error) {
+func init() {
+	RegisterBackend("s3", NewS3Storage)
+}
+
+// NewS3Storage creates a new S3Storage instance
+func NewS3Storage(ctx context.Context, config types.StorageConfig) (StorageBackend, error) {
 	region := config.Region
 	if region == "" {
 		region = "us-east-1"
@@ -66,239 +73,231 @@ func (s *S3Storage) New(ctx context.Context, config types.StorageConfig) (Storag
 		endpoint: endpoint,
 		region:   region,
 		client:   s3Client,
+		uploader: s3manager.NewUploaderWithClient(s3Client),
 	}, nil
 }
 
-// Blob streams the blob content from S3
-func (s *S3Storage) Blob(w http.ResponseWriter, r *http.Request, name string) {
-	ctx := r.Context()
-
-	// Create a GetObject request for the blob
-	input := &s3.GetObjectInput{
+// Open opens the blob for reading from S3. Reads are pinned to the ETag of
+// the object that was current when it was opened.
+func (s *S3Storage) Open(ctx context.Context, name string) (io.ReadSeekCloser, Descriptor, error) {
+	result, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.bucket),
-		Key:    aws.String(fmt.Sprintf("blobs/%s", name)),
-	}
-
-	// Get the object from S3
-	result, err := s.client.GetObjectWithContext(ctx, input)
-	if err != nil {
-		slog.ErrorContext(ctx, "Failed to get blob from S3", "name", name, "error", err)
-		http.Error(w, fmt.Sprintf("Failed to get blob: %v", err), http.StatusInternalServerError)
-		return
-	}
-	defer result.Body.Close()
-
-	// Set appropriate headers
-	if result.ContentType != nil {
-		w.Header().Set("Content-Type", *result.ContentType)
-	}
-	if result.ContentLength != nil {
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", *result.ContentLength))
-	}
-	if digest, ok := result.Metadata["Docker-Content-Digest"]; ok && digest != nil {
-		w.Header().Set("Docker-Content-Digest", *digest)
-	}
-
-	// Stream the content to the client using a buffer to improve performance
-	buf := make([]byte, 4096) // 4KB buffer
-	_, err = io.CopyBuffer(w, result.Body, buf)
+		Key:    aws.String(name),
+	})
 	if err != nil {
-		slog.ErrorContext(ctx, "Failed to stream blob content", "name", name, "error", err)
-		// Note: Headers might have been sent already, so we can't change the status code here
-	}
-}
-
-// BlobExists checks if a blob exists in S3
-func (s *S3Storage) BlobExists(ctx context.Context, name string) (v1.Descriptor, error) {
-	input := &s3.HeadObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(fmt.Sprintf("blobs/%s", name)),
+		return nil, Descriptor{}, s.error(name, err)
 	}
 
-	result, err := s.client.HeadObjectWithContext(ctx, input)
+	desc, err := s3Descriptor(result.ContentType, result.ContentLength, result.LastModified, result.ETag, result.Metadata)
 	if err != nil {
-		return v1.Descriptor{}, err
-	}
-
-	var h v1.Hash
-	if d, ok := result.Metadata["Docker-Content-Digest"]; ok && d != nil {
-		h, err = v1.NewHash(*d)
+		result.Body.Close()
+		return nil, Descriptor{}, err
+	}
+
+	// Later ranges are pinned to the ETag read here, so that an object
+	// replaced in the meantime fails the read instead of being spliced in.
+	etag := result.ETag
+	rr := newRangeReader(ctx, desc.Size, func(ctx context.Context, offset int64) (io.ReadCloser, error) {
+		result, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket:  aws.String(s.bucket),
+			Key:     aws.String(name),
+			Range:   aws.String(fmt.Sprintf("bytes=%d-", offset)),
+			IfMatch: etag,
+		})
 		if err != nil {
-			return v1.Descriptor{}, err
+			if isConditionFailed(err) {
+				return nil, fmt.Errorf("s3 %s: %w since it was opened", name, ErrObjectChanged)
+			}
+			return nil, s.error(name, err)
 		}
-	}
-
-	return v1.Descriptor{
-		Digest:    h,
-		MediaType: ocitypes.MediaType(*result.ContentType),
-		Size:      *result.ContentLength,
-	}, nil
+		return result.Body, nil
+	})
+	// Reuse the body we already have for reads from the start.
+	rr.rc = result.Body
+	return rr, desc, nil
 }
 
-// WriteObject writes a string object to S3
-func (s *S3Storage) WriteObject(ctx context.Context, name, contents string) error {
-	// Check if object already exists
-	_, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+// Stat checks if a blob exists in S3
+func (s *S3Storage) Stat(ctx context.Context, name string) (Descriptor, error) {
+	result, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(s.bucket),
-		Key:    aws.String(fmt.Sprintf("blobs/%s", name)),
-	})
-	if err == nil {
-		// Object already exists, no need to write
-		return nil
-	}
-
-	// Write the object
-	_, err = s.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
-		Bucket:      aws.String(s.bucket),
-		Key:         aws.String(fmt.Sprintf("blobs/%s", name)),
-		Body:        bytes.NewReader([]byte(contents + "\n")),
-		ContentType: aws.String("text/plain"),
+		Key:    aws.String(name),
 	})
 	if err != nil {
-		return fmt.Errorf("failed to write object: %v", err)
+		return Descriptor{}, s.error(name, err)
 	}
-	return nil
+	return s3Descriptor(result.ContentType, result.ContentLength, result.LastModified, result.ETag, result.Metadata)
 }
 
-// WriteBlob writes a blob to S3
-func (s *S3Storage) WriteBlob(ctx context.Context, name string, h v1.Hash, rc io.ReadCloser, contentType string) error {
+// Put writes a blob to S3
+func (s *S3Storage) Put(ctx context.Context, name string, desc Descriptor, r io.Reader) error {
 	start := time.Now()
-	defer func() { slog.InfoContext(ctx, "s3WriteBlob(%q) took %s", name, time.Since(start)) }()
+	defer func() { slog.InfoContext(ctx, "s3Put", "name", name, "took", time.Since(start)) }()
 
-	// Check if object already exists
-	_, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(fmt.Sprintf("blobs/%s", name)),
-	})
-	if err == nil {
-		// Object already exists, no need to write
-		return nil
-	}
-
-	// Read the entire content
-	data, err := io.ReadAll(rc)
-	if err != nil {
-		return fmt.Errorf("failed to read content: %v", err)
+	input := &s3manager.UploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(name),
+		Body:        r,
+		ContentType: aws.String(string(desc.MediaType)),
 	}
-	if err := rc.Close(); err != nil {
-		return fmt.Errorf("rc.Close: %v", err)
+	if desc.Digest != (v1.Hash{}) {
+		input.Metadata = map[string]*string{
+			"Docker-Content-Digest": aws.String(desc.Digest.String()),
+		}
 	}
-
-	// Write the object
-	_, err = s.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
-		Bucket:      aws.String(s.bucket),
-		Key:         aws.String(fmt.Sprintf("blobs/%s", name)),
-		Body:        bytes.NewReader(data),
-		ContentType: aws.String(contentType),
-		Metadata: map[string]*string{
-			"Docker-Content-Digest": aws.String(h.String()),
-		},
-	})
-	if err != nil {
-		return fmt.Errorf("failed to write blob: %v", err)
+	if _, err := s.uploader.UploadWithContext(ctx, input); err != nil {
+		return fmt.Errorf("failed to write blob: %w", err)
 	}
 	return nil
 }
 
-// WriteImage writes the layer blobs, config blob and manifest to S3
-func (s *S3Storage) WriteImage(ctx context.Context, img v1.Image, also ...string) error {
-	// Write config blob for later serving.
-	ch, err := img.ConfigName()
+// Create writes an object to S3 unless it already exists. It relies on S3
+// conditional writes (If-None-Match: *), so the object is sent in a single
+// request and should be small.
+func (s *S3Storage) Create(ctx context.Context, name string, desc Descriptor, r io.Reader) error {
+	b, err := io.ReadAll(r)
 	if err != nil {
-		return err
+		return fmt.Errorf("copy: %w", err)
 	}
-	cb, err := img.RawConfigFile()
-	if err != nil {
-		return err
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(name),
+		Body:        bytes.NewReader(b),
+		ContentType: aws.String(string(desc.MediaType)),
 	}
-	if err := s.WriteBlob(ctx, ch.String(), ch, io.NopCloser(bytes.NewReader(cb)), "application/json"); err != nil {
-		return err
+	if desc.Digest != (v1.Hash{}) {
+		input.Metadata = map[string]*string{
+			"Docker-Content-Digest": aws.String(desc.Digest.String()),
+		}
 	}
-
-	// Write layer blobs for later serving.
-	layers, err := img.Layers()
+	_, err = s.client.PutObjectWithContext(ctx, input,
+		request.WithSetRequestHeaders(map[string]string{"If-None-Match": "*"}))
 	if err != nil {
-		return err
-	}
-	var g errgroup.Group
-	for _, l := range layers {
-		l := l
-		g.Go(func() error {
-			rc, err := l.Compressed()
-			if err != nil {
-				return err
-			}
-			lh, err := l.Digest()
-			if err != nil {
-				return err
-			}
-			mt, err := l.MediaType()
-			if err != nil {
-				return err
-			}
-			return s.WriteBlob(ctx, lh.String(), lh, rc, string(mt))
-		})
-	}
-	if err := g.Wait(); err != nil {
-		return err
+		if isConditionFailed(err) {
+			return fmt.Errorf("%w: %s", ErrObjectExists, name)
+		}
+		return fmt.Errorf("failed to create blob: %w", err)
 	}
+	return nil
+}
 
-	// Write the manifest as a blob.
-	b, err := img.RawManifest()
-	if err != nil {
-		return err
-	}
-	mt, err := img.MediaType()
+// Replace writes an object to S3 if its ETag is still version, with an
+// If-Match conditional write. Like Create, it sends the object in a single
+// request.
+func (s *S3Storage) Replace(ctx context.Context, name, version string, desc Descriptor, r io.Reader) error {
+	b, err := io.ReadAll(r)
 	if err != nil {
-		return err
+		return fmt.Errorf("copy: %w", err)
 	}
-	digest, err := img.Digest()
-	if err != nil {
-		return err
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(name),
+		Body:        bytes.NewReader(b),
+		ContentType: aws.String(string(desc.MediaType)),
 	}
-	if err := s.WriteBlob(ctx, digest.String(), digest, io.NopCloser(bytes.NewReader(b)), string(mt)); err != nil {
-		return err
+	if desc.Digest != (v1.Hash{}) {
+		input.Metadata = map[string]*string{
+			"Docker-Content-Digest": aws.String(desc.Digest.String()),
+		}
 	}
-	for _, a := range also {
-		a := a
-		g.Go(func() error {
-			return s.WriteBlob(ctx, a, digest, io.NopCloser(bytes.NewReader(b)), string(mt))
-		})
+	_, err = s.client.PutObjectWithContext(ctx, input,
+		request.WithSetRequestHeaders(map[string]string{"If-Match": version}))
+	if err != nil {
+		if isConditionFailed(err) || errors.Is(s.error(name, err), ErrBlobUnknown) {
+			return fmt.Errorf("%w: %s", ErrObjectChanged, name)
+		}
+		return fmt.Errorf("failed to replace blob: %w", err)
 	}
-	return g.Wait()
+	return nil
 }
 
-// ServeManifest writes config and layer blobs for the image, then writes and
-// redirects to the image manifest contents pointing to those blobs.
-func (s *S3Storage) ServeManifest(w http.ResponseWriter, r *http.Request, img v1.Image, also ...string) error {
-	ctx := r.Context()
+// DeleteVersion removes an object from S3 if its ETag is still version.
+func (s *S3Storage) DeleteVersion(ctx context.Context, name, version string) error {
+	_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+	}, request.WithSetRequestHeaders(map[string]string{"If-Match": version}))
+	switch {
+	case err == nil, errors.Is(s.error(name, err), ErrBlobUnknown):
+		return nil
+	case isConditionFailed(err):
+		return fmt.Errorf("%w: %s", ErrObjectChanged, name)
+	}
+	return fmt.Errorf("failed to delete blob: %w", err)
+}
 
-	if err := s.WriteImage(ctx, img, also...); err != nil {
-		return err
+// isConditionFailed reports whether err is S3 refusing a conditional request.
+func isConditionFailed(err error) bool {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		switch aerr.Code() {
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return true
+		}
 	}
+	return false
+}
 
-	digest, err := img.Digest()
+// Delete removes a blob from S3
+func (s *S3Storage) Delete(ctx context.Context, name string) error {
+	_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+	})
 	if err != nil {
-		return err
+		if err := s.error(name, err); errors.Is(err, ErrBlobUnknown) {
+			return nil
+		}
+		return fmt.Errorf("failed to delete blob: %w", err)
 	}
+	return nil
+}
 
-	// If it's just a HEAD request, serve that.
-	if r.Method == http.MethodHead {
-		mt, err := img.MediaType()
-		if err != nil {
-			return err
+// List lists the keys in the bucket that start with prefix
+func (s *S3Storage) List(ctx context.Context, prefix string, fn func(name string) error) error {
+	var ferr error
+	err := s.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if ferr = fn(aws.StringValue(obj.Key)); ferr != nil {
+				return false
+			}
 		}
-		size, err := img.Size()
-		if err != nil {
-			return err
+		return true
+	})
+	if ferr != nil {
+		return ferr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %w", err)
+	}
+	return nil
+}
+
+// error maps S3 "not found" errors to ErrBlobUnknown.
+func (s *S3Storage) error(name string, err error) error {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return fmt.Errorf("%w: %s", ErrBlobUnknown, name)
 		}
-		w.Header().Set("Docker-Content-Digest", digest.String())
-		w.Header().Set("Content-Type", string(mt))
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
-		return nil
 	}
+	return fmt.Errorf("s3 %s: %w", name, err)
+}
 
-	// Stream the manifest blob from S3.
-	s.Blob(w, r, digest.String())
-	return nil
+func s3Descriptor(contentType *string, contentLength *int64, lastModified *time.Time, etag *string, metadata map[string]*string) (Descriptor, error) {
+	h, err := parseDigest(aws.StringValue(metadata["Docker-Content-Digest"]))
+	if err != nil {
+		return Descriptor{}, err
+	}
+	return Descriptor{
+		Digest:       h,
+		MediaType:    ocitypes.MediaType(aws.StringValue(contentType)),
+		Size:         aws.Int64Value(contentLength),
+		LastModified: aws.TimeValue(lastModified),
+		Version:      aws.StringValue(etag),
+	}, nil
 }
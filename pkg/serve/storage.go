@@ -2,49 +2,201 @@ package serve
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"net/http"
+	"sort"
+	"sync"
+	"time"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	ocitypes "github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/tuananh/helm-oci-proxy/pkg/types"
 )
 
-// StorageBackend defines the interface for storage operations
+// Descriptor describes an object held by a StorageBackend.
+type Descriptor struct {
+	// Digest is the Docker-Content-Digest recorded for the content, if any.
+	Digest    v1.Hash
+	MediaType ocitypes.MediaType
+	Size      int64
+	// LastModified is when the object was written, if the backend knows.
+	LastModified time.Time
+	// Version identifies what is stored under the name, e.g. the GCS
+	// generation or the S3 ETag, for conditional writes. It is empty if the
+	// backend doesn't know.
+	Version string
+}
+
+// StorageBackend defines the interface for storage operations. Backends only
+// store and retrieve named objects; the registry HTTP semantics live in
+// ServeBlob and ServeManifest.
 type StorageBackend interface {
-	// New creates a new storage instance
-	New(ctx context.Context, config types.StorageConfig) (StorageBackend, error)
+	// Open opens the named object for reading. It returns an error wrapping
+	// ErrBlobUnknown if the object does not exist.
+	Open(ctx context.Context, name string) (io.ReadSeekCloser, Descriptor, error)
+
+	// Stat returns the descriptor of the named object. It returns an error
+	// wrapping ErrBlobUnknown if the object does not exist.
+	Stat(ctx context.Context, name string) (Descriptor, error)
+
+	// Put writes the contents of r under name, replacing any existing object.
+	Put(ctx context.Context, name string, desc Descriptor, r io.Reader) error
+
+	// Delete removes the named object. Deleting a missing object is not an
+	// error.
+	Delete(ctx context.Context, name string) error
+
+	// List calls fn for the name of every object that starts with prefix.
+	// Iteration stops at the first error returned by fn.
+	List(ctx context.Context, prefix string, fn func(name string) error) error
+}
+
+// ErrObjectExists is returned by Create when the object already exists.
+var ErrObjectExists = errors.New("object already exists")
+
+// Creator is implemented by storage backends that can create an object only
+// if it doesn't exist yet, atomically with respect to other writers. It is
+// what replicas use to coordinate, e.g. for build leases.
+type Creator interface {
+	// Create writes the contents of r under name unless an object of that
+	// name exists, in which case it returns an error wrapping
+	// ErrObjectExists.
+	Create(ctx context.Context, name string, desc Descriptor, r io.Reader) error
+}
 
-	// Blob redirects to the blob in the storage
-	Blob(w http.ResponseWriter, r *http.Request, name string)
+// Create creates the named object in st if it doesn't exist yet. It fails
+// with errors.ErrUnsupported if st doesn't implement Creator.
+func Create(ctx context.Context, st StorageBackend, name string, desc Descriptor, r io.Reader) error {
+	c, ok := st.(Creator)
+	if !ok {
+		return fmt.Errorf("%T can't create objects conditionally: %w", st, errors.ErrUnsupported)
+	}
+	return c.Create(ctx, name, desc, r)
+}
 
-	// BlobExists checks if a blob exists in the storage
-	BlobExists(ctx context.Context, name string) (v1.Descriptor, error)
+// ErrObjectChanged is returned by Replace and DeleteVersion when the object
+// is no longer the version they were given.
+var ErrObjectChanged = errors.New("object changed")
 
-	// WriteObject writes a string object to storage
-	WriteObject(ctx context.Context, name, contents string) error
+// Swapper is implemented by storage backends that can replace or delete an
+// object only if it is still the version that was read, atomically with
+// respect to other writers. Along with Creator, it is what build leases are
+// taken over and renewed with.
+type Swapper interface {
+	// Replace writes the contents of r under name if the object's version is
+	// still version. Otherwise, or if the object is gone, it returns an
+	// error wrapping ErrObjectChanged.
+	Replace(ctx context.Context, name, version string, desc Descriptor, r io.Reader) error
 
-	// WriteBlob writes a blob to storage
-	WriteBlob(ctx context.Context, name string, h v1.Hash, rc io.ReadCloser, contentType string) error
+	// DeleteVersion removes the named object if its version is still
+	// version, and returns an error wrapping ErrObjectChanged otherwise.
+	// Deleting a missing object is not an error.
+	DeleteVersion(ctx context.Context, name, version string) error
+}
 
-	// WriteImage writes the layer blobs, config blob and manifest
-	WriteImage(ctx context.Context, img v1.Image, also ...string) error
+// Replace replaces the named object in st if it is still version. It fails
+// with errors.ErrUnsupported if st doesn't implement Swapper.
+func Replace(ctx context.Context, st StorageBackend, name, version string, desc Descriptor, r io.Reader) error {
+	sw, ok := st.(Swapper)
+	if !ok {
+		return fmt.Errorf("%T can't replace objects conditionally: %w", st, errors.ErrUnsupported)
+	}
+	return sw.Replace(ctx, name, version, desc, r)
+}
 
-	// ServeManifest writes config and layer blobs for the image, then writes and
-	// redirects to the image manifest contents pointing to those blobs
-	ServeManifest(w http.ResponseWriter, r *http.Request, img v1.Image, also ...string) error
+// DeleteVersion deletes the named object from st if it is still version. It
+// fails with errors.ErrUnsupported if st doesn't implement Swapper.
+func DeleteVersion(ctx context.Context, st StorageBackend, name, version string) error {
+	sw, ok := st.(Swapper)
+	if !ok {
+		return fmt.Errorf("%T can't delete objects conditionally: %w", st, errors.ErrUnsupported)
+	}
+	return sw.DeleteVersion(ctx, name, version)
 }
 
-// NewStorageWithConfig creates a new Storage instance with the provided configuration
+// BackendFactory creates a StorageBackend from its configuration. Options
+// specific to the backend can be read with config.Decode.
+type BackendFactory func(ctx context.Context, config types.StorageConfig) (StorageBackend, error)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = map[string]BackendFactory{}
+)
+
+// RegisterBackend makes a storage backend available under the given name, which
+// is matched against the storage type in the config. It is meant to be called
+// from init functions and panics if the name is already registered.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if factory == nil {
+		panic("serve: RegisterBackend factory is nil")
+	}
+	if _, dup := backends[name]; dup {
+		panic(fmt.Sprintf("serve: RegisterBackend called twice for backend %q", name))
+	}
+	backends[name] = factory
+}
+
+// Backends returns the sorted names of the registered storage backends.
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewStorageWithConfig creates a new Storage instance with the provided
+// configuration. Objects are stored under the keys of the configured layout.
 func NewStorageWithConfig(ctx context.Context, config types.StorageConfig) (StorageBackend, error) {
-	switch config.Type {
-	case "s3":
-		s3Storage := &S3Storage{}
-		return s3Storage.New(ctx, config)
-	case "gcs":
-		gcsStorage := &GCSStorage{}
-		return gcsStorage.New(ctx, config)
-	default:
-		return nil, fmt.Errorf("unsupported storage type: %s", config.Type)
+	layout, err := NewLayout(config)
+	if err != nil {
+		return nil, err
+	}
+	st, err := NewBackend(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	st = NewLayoutStorage(st, layout)
+
+	if config.VerifyDigests {
+		st = NewVerifyingStorage(st)
+	}
+
+	if config.Cache != nil {
+		cached, err := NewCachedStorage(st, *config.Cache)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create storage cache: %w", err)
+		}
+		st = cached
+	}
+	return st, nil
+}
+
+// parseDigest parses the digest recorded in object metadata. Objects written
+// without a digest yield the zero hash.
+func parseDigest(s string) (v1.Hash, error) {
+	if s == "" {
+		return v1.Hash{}, nil
+	}
+	return v1.NewHash(s)
+}
+
+// NewBackend creates the registered backend for config.Type. Unlike
+// NewStorageWithConfig, names are used as bucket keys verbatim.
+func NewBackend(ctx context.Context, config types.StorageConfig) (StorageBackend, error) {
+	backendsMu.RLock()
+	factory, ok := backends[config.Type]
+	backendsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported storage type: %s (available: %v)", config.Type, Backends())
 	}
+	return factory(ctx, config)
 }
@@ -0,0 +1,74 @@
+package serve
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Limits of the distribution spec.
+const (
+	maxNameLength = 255
+	maxTagLength  = 128
+)
+
+var (
+	// ErrNameInvalid is reported for repository names that don't follow
+	// the distribution-spec grammar.
+	ErrNameInvalid = &RegistryError{Code: "NAME_INVALID", Status: http.StatusBadRequest, Message: "invalid repository name"}
+
+	// ErrTagInvalid is reported for malformed tags.
+	ErrTagInvalid = &RegistryError{Code: "TAG_INVALID", Status: http.StatusBadRequest, Message: "invalid tag"}
+
+	// ErrDigestInvalid is reported for malformed or unsupported digests.
+	ErrDigestInvalid = &RegistryError{Code: "DIGEST_INVALID", Status: http.StatusBadRequest, Message: "invalid digest"}
+)
+
+var (
+	nameRE   = regexp.MustCompile(`^[a-z0-9]+(?:(?:\.|_|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:\.|_|__|-+)[a-z0-9]+)*)*$`)
+	tagRE    = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]*$`)
+	digestRE = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+// ValidateName checks a repository name, "<namespace>/<chart>", against the
+// distribution-spec grammar: lowercase path components without dot segments.
+func ValidateName(name string) error {
+	if len(name) > maxNameLength {
+		return fmt.Errorf("%w: longer than %d characters", ErrNameInvalid, maxNameLength)
+	}
+	if !nameRE.MatchString(name) {
+		return fmt.Errorf("%w: %q", ErrNameInvalid, name)
+	}
+	return nil
+}
+
+// ValidateTag checks a tag against the distribution-spec grammar.
+func ValidateTag(tag string) error {
+	if len(tag) > maxTagLength {
+		return fmt.Errorf("%w: longer than %d characters", ErrTagInvalid, maxTagLength)
+	}
+	if !tagRE.MatchString(tag) {
+		return fmt.Errorf("%w: %q", ErrTagInvalid, tag)
+	}
+	return nil
+}
+
+// ValidateDigest checks that digest is a well-formed sha256 digest, the only
+// algorithm the proxy stores content under.
+func ValidateDigest(digest string) error {
+	if len(digest) > 2*maxTagLength {
+		return fmt.Errorf("%w: longer than %d characters", ErrDigestInvalid, 2*maxTagLength)
+	}
+	if !digestRE.MatchString(digest) {
+		return fmt.Errorf("%w: %q", ErrDigestInvalid, digest)
+	}
+	return nil
+}
+
+// IsDigestReference reports whether a manifest reference is a digest rather
+// than a tag. Tags can't contain ":", so anything that does is meant as a
+// digest, valid or not.
+func IsDigestReference(ref string) bool {
+	return strings.Contains(ref, ":")
+}
@@ -0,0 +1,121 @@
+package serve
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"argo/argo-cd", true},
+		{"argo/argo_cd", true},
+		{"argo/argo__cd", true},
+		{"argo/argo--cd", true},
+		{"argo/argo.cd", true},
+		{"internal-a/team/chart", true},
+		{"chart", true},
+		{"Argo/argo-cd", false},
+		{"argo/../argo-cd", false},
+		{"argo/./argo-cd", false},
+		{"argo//argo-cd", false},
+		{"/argo/argo-cd", false},
+		{"argo/argo-cd/", false},
+		{"argo/-argo-cd", false},
+		{"argo/argo-cd-", false},
+		{"argo/argo..cd", false},
+		{"argo/argo___cd", false},
+		{"argo/argo cd", false},
+		{"", false},
+		{strings.Repeat("a", maxNameLength), true},
+		{strings.Repeat("a", maxNameLength+1), false},
+	}
+	for _, tt := range tests {
+		err := ValidateName(tt.name)
+		if (err == nil) != tt.ok {
+			t.Errorf("ValidateName(%q) = %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if err != nil && !errors.Is(err, ErrNameInvalid) {
+			t.Errorf("ValidateName(%q) = %v, want ErrNameInvalid", tt.name, err)
+		}
+	}
+}
+
+func TestValidateTag(t *testing.T) {
+	tests := []struct {
+		tag string
+		ok  bool
+	}{
+		{"1.2.3", true},
+		{"v1.2.3", true},
+		{"1.2.3-rc.1", true},
+		{"_latest", true},
+		{"1.2.3+build", false},
+		{".1.2.3", false},
+		{"-1.2.3", false},
+		{"1.2/3", false},
+		{"", false},
+		{strings.Repeat("a", maxTagLength), true},
+		{strings.Repeat("a", maxTagLength+1), false},
+	}
+	for _, tt := range tests {
+		err := ValidateTag(tt.tag)
+		if (err == nil) != tt.ok {
+			t.Errorf("ValidateTag(%q) = %v, want ok %v", tt.tag, err, tt.ok)
+		}
+		if err != nil && !errors.Is(err, ErrTagInvalid) {
+			t.Errorf("ValidateTag(%q) = %v, want ErrTagInvalid", tt.tag, err)
+		}
+	}
+}
+
+func TestValidateDigest(t *testing.T) {
+	hex := strings.Repeat("0123456789abcdef", 4)
+	tests := []struct {
+		digest string
+		ok     bool
+	}{
+		{"sha256:" + hex, true},
+		{"sha256:" + strings.ToUpper(hex), false},
+		{"sha256:" + hex[1:], false},
+		{"sha256:" + hex + "0", false},
+		{"sha512:" + hex + hex, false},
+		{"sha256:" + hex[:63] + "g", false},
+		{hex, false},
+		{"", false},
+		{"sha256:" + strings.Repeat("0", 2*maxTagLength), false},
+	}
+	for _, tt := range tests {
+		err := ValidateDigest(tt.digest)
+		if (err == nil) != tt.ok {
+			t.Errorf("ValidateDigest(%q) = %v, want ok %v", tt.digest, err, tt.ok)
+		}
+		if err != nil && !errors.Is(err, ErrDigestInvalid) {
+			t.Errorf("ValidateDigest(%q) = %v, want ErrDigestInvalid", tt.digest, err)
+		}
+	}
+
+	long := "sha256:" + strings.Repeat("0", 2*maxTagLength)
+	if err := ValidateDigest(long); err == nil || strings.Contains(err.Error(), long) {
+		t.Errorf("ValidateDigest of an overlong digest = %v, want an error not quoting it", err)
+	}
+}
+
+func TestIsDigestReference(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want bool
+	}{
+		{"1.2.3", false},
+		{"sha256:abc", true},
+		{"md5:abc", true},
+	}
+	for _, tt := range tests {
+		if got := IsDigestReference(tt.ref); got != tt.want {
+			t.Errorf("IsDigestReference(%q) = %v, want %v", tt.ref, got, tt.want)
+		}
+	}
+}
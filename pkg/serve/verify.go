@@ -0,0 +1,203 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"golang.org/x/sync/errgroup"
+	"helm.sh/helm/v3/pkg/chart"
+)
+
+// Problem is an inconsistency found by Verify.
+type Problem struct {
+	Name     string // Object the problem was found in
+	Kind     string // "corrupt", "invalid" or "incomplete"
+	Detail   string
+	Repaired bool
+}
+
+// VerifyOptions controls Verify.
+type VerifyOptions struct {
+	// Repair deletes corrupt blobs and calls Rebuild for every tag pointer
+	// that is invalid or references missing or corrupt content.
+	Repair bool
+
+	// Rebuild rebuilds the chart of a tag pointer from upstream. md is the
+	// chart metadata read from the pointer's config blob. If that can't be
+	// read, it only has the chart name and version, taken from the
+	// pointer's name or its index entry, or is nil if neither has them.
+	Rebuild func(ctx context.Context, tagName string, md *chart.Metadata) error
+
+	// Concurrency is the number of blobs hashed in parallel.
+	Concurrency int
+}
+
+// Verify checks that every blob matches its digest and the digest recorded
+// in its metadata, and that the manifest of every tag pointer parses and
+// references a config and layers that exist.
+func Verify(ctx context.Context, st StorageBackend, opts VerifyOptions) ([]Problem, error) {
+	var (
+		mu       sync.Mutex
+		problems []Problem
+		blobs    []string
+		pointers []string
+	)
+	report := func(p Problem) {
+		mu.Lock()
+		defer mu.Unlock()
+		problems = append(problems, p)
+	}
+
+	if err := st.List(ctx, "", func(name string) error {
+		switch {
+		case isDigest(name):
+			blobs = append(blobs, name)
+		case IsTagPointer(name):
+			pointers = append(pointers, name)
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to list storage: %w", err)
+	}
+
+	// Re-hash every blob.
+	corrupt := map[string]bool{}
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(opts.Concurrency, 1))
+	for _, name := range blobs {
+		g.Go(func() error {
+			detail, err := verifyBlob(gctx, st, name)
+			if err != nil || detail == "" {
+				return err
+			}
+			mu.Lock()
+			corrupt[name] = true
+			mu.Unlock()
+			report(Problem{Name: name, Kind: "corrupt", Detail: detail})
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return problems, err
+	}
+
+	// Check that what each tag pointer references is there and intact.
+	type broken struct {
+		name string
+		md   *chart.Metadata
+	}
+	var rebuild []broken
+	for _, name := range pointers {
+		m, desc, err := ReadManifest(ctx, st, name)
+		if errors.Is(err, ErrBlobUnknown) {
+			continue
+		} else if err != nil {
+			report(Problem{Name: name, Kind: "invalid", Detail: err.Error()})
+			rebuild = append(rebuild, broken{name: name, md: chartOf(ctx, st, name)})
+			continue
+		}
+
+		var missing []string
+		refs := []v1.Hash{desc.Digest, m.Config.Digest}
+		for _, l := range m.Layers {
+			refs = append(refs, l.Digest)
+		}
+		for _, h := range refs {
+			if h == (v1.Hash{}) {
+				continue
+			}
+			if corrupt[h.String()] {
+				missing = append(missing, h.String()+" (corrupt)")
+				continue
+			}
+			if _, err := st.Stat(ctx, h.String()); errors.Is(err, ErrBlobUnknown) {
+				missing = append(missing, h.String())
+			} else if err != nil {
+				return problems, err
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		report(Problem{Name: name, Kind: "incomplete", Detail: "missing " + strings.Join(missing, ", ")})
+
+		var md *chart.Metadata
+		if !corrupt[ChartMetadataDigest(m).String()] {
+			md, _ = ReadChartMetadata(ctx, st, name)
+		}
+		if md == nil {
+			md = chartOf(ctx, st, name)
+		}
+		rebuild = append(rebuild, broken{name: name, md: md})
+	}
+
+	if !opts.Repair {
+		return problems, nil
+	}
+
+	// Corrupt blobs go first, so that rebuilding writes them again.
+	repaired := map[string]bool{}
+	for name := range corrupt {
+		if err := st.Delete(ctx, name); err != nil {
+			return problems, err
+		}
+		repaired[name] = true
+	}
+	for _, b := range rebuild {
+		if opts.Rebuild == nil {
+			break
+		}
+		if err := opts.Rebuild(ctx, b.name, b.md); err != nil {
+			report(Problem{Name: b.name, Kind: "invalid", Detail: fmt.Sprintf("rebuild failed: %v", err)})
+			continue
+		}
+		repaired[b.name] = true
+	}
+	for i := range problems {
+		problems[i].Repaired = repaired[problems[i].Name]
+	}
+	return problems, nil
+}
+
+// chartOf returns the chart name and version of the tag pointer tagName
+// without reading what it references: from its name, or else from its index
+// entry. It returns nil if neither has them.
+func chartOf(ctx context.Context, st StorageBackend, tagName string) *chart.Metadata {
+	if _, name, version, ok := ParseTagName(tagName); ok {
+		return &chart.Metadata{Name: name, Version: version}
+	}
+	if e, err := ReadIndexEntry(ctx, st, tagName); err == nil && e.Chart != "" && e.Version != "" {
+		return &chart.Metadata{Name: e.Chart, Version: e.Version}
+	}
+	return nil
+}
+
+// verifyBlob re-hashes a blob. It returns a description of the problem, or
+// "" if the blob is intact.
+func verifyBlob(ctx context.Context, st StorageBackend, name string) (string, error) {
+	rc, desc, err := st.Open(ctx, name)
+	if errors.Is(err, ErrBlobUnknown) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	h, size, err := v1.SHA256(rc)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	switch {
+	case h.String() != name:
+		return fmt.Sprintf("content hashes to %s", h), nil
+	case desc.Digest != (v1.Hash{}) && desc.Digest.String() != name:
+		return fmt.Sprintf("Docker-Content-Digest metadata is %s", desc.Digest), nil
+	case size != desc.Size:
+		return fmt.Sprintf("read %d bytes, expected %d", size, desc.Size), nil
+	}
+	return "", nil
+}
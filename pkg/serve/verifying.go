@@ -0,0 +1,172 @@
+package serve
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// ErrDigestMismatch is returned when streamed content does not match its digest.
+var ErrDigestMismatch = errors.New("content does not match digest")
+
+// digestMismatches counts blobs found to be corrupt while streaming them. It
+// is published on /debug/vars so that it can be alerted on.
+var digestMismatches = expvar.NewInt("digest_mismatches")
+
+// QuarantineName returns the name a corrupt blob is moved to.
+func QuarantineName(digest string) string {
+	return "_quarantine/" + digest
+}
+
+// verifyingStorage is a StorageBackend that hashes digest-addressed blobs
+// while they are read. If the content turns out not to match, the read fails
+// and the blob is moved to quarantine, so that it is neither served again nor
+// lost for inspection.
+type verifyingStorage struct {
+	StorageBackend
+
+	quarantining sync.Map
+}
+
+// NewVerifyingStorage wraps backend so that digest-addressed blobs are
+// verified while they are read.
+func NewVerifyingStorage(backend StorageBackend) StorageBackend {
+	return &verifyingStorage{StorageBackend: backend}
+}
+
+func (s *verifyingStorage) Open(ctx context.Context, name string) (io.ReadSeekCloser, Descriptor, error) {
+	rc, desc, err := s.StorageBackend.Open(ctx, name)
+	if err != nil || !isDigest(name) {
+		return rc, desc, err
+	}
+	h, _ := v1.NewHash(name)
+	if h.Algorithm != "sha256" {
+		return rc, desc, nil
+	}
+	return &verifyingReader{
+		ReadSeekCloser: rc,
+		want:           h.Hex,
+		size:           desc.Size,
+		hash:           sha256.New(),
+		onMismatch: func(got string) {
+			s.quarantine(ctx, name, got)
+		},
+	}, desc, nil
+}
+
+func (s *verifyingStorage) Create(ctx context.Context, name string, desc Descriptor, r io.Reader) error {
+	return Create(ctx, s.StorageBackend, name, desc, r)
+}
+
+func (s *verifyingStorage) Replace(ctx context.Context, name, version string, desc Descriptor, r io.Reader) error {
+	return Replace(ctx, s.StorageBackend, name, version, desc, r)
+}
+
+func (s *verifyingStorage) DeleteVersion(ctx context.Context, name, version string) error {
+	return DeleteVersion(ctx, s.StorageBackend, name, version)
+}
+
+// quarantine moves a corrupt blob out of the way. It runs in the background,
+// once per blob at a time.
+func (s *verifyingStorage) quarantine(ctx context.Context, name, got string) {
+	digestMismatches.Add(1)
+	slog.ErrorContext(ctx, "blob does not match its digest, quarantining", "name", name, "actual", got)
+
+	if _, loaded := s.quarantining.LoadOrStore(name, true); loaded {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		defer s.quarantining.Delete(name)
+
+		rc, desc, err := s.StorageBackend.Open(ctx, name)
+		if errors.Is(err, ErrBlobUnknown) {
+			return
+		} else if err != nil {
+			slog.ErrorContext(ctx, "failed to quarantine blob", "name", name, "err", err)
+			return
+		}
+		defer rc.Close()
+		if err := s.StorageBackend.Put(ctx, QuarantineName(name), desc, rc); err != nil {
+			slog.ErrorContext(ctx, "failed to quarantine blob", "name", name, "err", err)
+			return
+		}
+		if err := s.StorageBackend.Delete(ctx, name); err != nil {
+			slog.ErrorContext(ctx, "failed to delete quarantined blob", "name", name, "err", err)
+		}
+	}()
+}
+
+// verifyingReader hashes content as it is read from the start to the end.
+// The last chunk is withheld if the content doesn't match, so that a client
+// never receives a complete corrupt blob. Partial reads, as for range
+// requests, are not verified.
+type verifyingReader struct {
+	io.ReadSeekCloser
+	want       string
+	size       int64
+	hash       hash.Hash
+	onMismatch func(got string)
+
+	off      int64 // bytes hashed so far
+	pos      int64 // position of the underlying reader
+	disabled bool
+	failed   bool
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	if r.failed {
+		return 0, ErrDigestMismatch
+	}
+	if r.pos != r.off {
+		r.disabled = true
+	}
+	n, err := r.ReadSeekCloser.Read(p)
+	r.pos += int64(n)
+	if r.disabled {
+		return n, err
+	}
+	r.hash.Write(p[:n])
+	r.off += int64(n)
+
+	if r.off < r.size && err == nil {
+		return n, nil
+	}
+	if r.off > r.size || errors.Is(err, io.ErrUnexpectedEOF) || (err == io.EOF && r.off < r.size) {
+		return 0, r.mismatch(fmt.Sprintf("%d of %d bytes", r.off, r.size))
+	}
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+	if got := hex.EncodeToString(r.hash.Sum(nil)); got != r.want {
+		return 0, r.mismatch("sha256:" + got)
+	}
+	// Verified; nothing more to hash.
+	r.disabled = true
+	return n, err
+}
+
+func (r *verifyingReader) mismatch(got string) error {
+	r.failed = true
+	r.onMismatch(got)
+	return ErrDigestMismatch
+}
+
+// Seek is passed through. Seeking to the end to learn the size and back is
+// fine; reading from anywhere but where hashing stopped disables it.
+func (r *verifyingReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.ReadSeekCloser.Seek(offset, whence)
+	if err == nil {
+		r.pos = pos
+	}
+	return pos, err
+}
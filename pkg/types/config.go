@@ -1,22 +1,254 @@
 package types
 
+import (
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
 // Config represents the application configuration
 type Config struct {
 	Port         string        `yaml:"port"`
+	TLS          *TLSConfig    `yaml:"tls"` // Serves HTTPS rather than plain HTTP
 	Repositories []RepoConfig  `yaml:"repositories"`
 	Storage      StorageConfig `yaml:"storage"`
+
+	// RetentionInterval runs the retention policies in the background at
+	// this interval. Zero disables the background job.
+	RetentionInterval time.Duration `yaml:"retentionInterval"`
+
+	// Lock coordinates builds between replicas, so that a chart version is
+	// only built by one of them. Without it, builds are only deduplicated
+	// within each process.
+	Lock *LockConfig `yaml:"lock"`
+
+	// DisableLegacyTags stops looking up tag pointers under the md5 keys
+	// of earlier releases. They are no longer looked up in a storage once
+	// migrate-tags has moved them all, so this only matters before then.
+	DisableLegacyTags bool `yaml:"disableLegacyTags"`
+
+	// Auth requires clients to authenticate. Without it, anyone who can
+	// reach the proxy can pull.
+	Auth *AuthConfig `yaml:"auth"`
+
+	// Outbound restricts what the proxy downloads from upstream.
+	Outbound OutboundConfig `yaml:"outbound"`
+
+	// RateLimit limits how much each client may ask of the proxy and its
+	// upstreams.
+	RateLimit *RateLimitConfig `yaml:"rateLimit"`
+
+	// Audit records pulls and builds, e.g. for compliance.
+	Audit *AuditConfig `yaml:"audit"`
+
+	// TrustForwardedFor takes client addresses, for rate limits and the
+	// audit log, from X-Forwarded-For, for proxies behind a load balancer.
+	TrustForwardedFor bool `yaml:"trustForwardedFor"`
+
+	// ACL limits what clients may pull. Without it, every client that
+	// authenticates may pull from every namespace.
+	ACL *ACLConfig `yaml:"acl"`
 }
 
 // RepoConfig represents a Helm repository configuration
 type RepoConfig struct {
-	URL    string `yaml:"url"`
-	Prefix string `yaml:"prefix"`
+	URL       string           `yaml:"url"`
+	Prefix    string           `yaml:"prefix"`
+	Retention *RetentionConfig `yaml:"retention"`
+	Storage   *StorageConfig   `yaml:"storage"` // Overrides the storage for this namespace
+
+	// AllowedHosts are globs of the hosts chart URLs in the index may point
+	// to, besides the repository's own. Empty allows any host.
+	AllowedHosts []string `yaml:"allowedHosts"`
+}
+
+// TLSConfig represents the TLS configuration of the listener. Files are read
+// again when they change.
+type TLSConfig struct {
+	CertFile   string `yaml:"certFile"`   // PEM certificate chain
+	KeyFile    string `yaml:"keyFile"`    // PEM private key
+	MinVersion string `yaml:"minVersion"` // "1.2" (default) or "1.3"
+
+	// ClientCAFile enables mutual TLS: clients must present a certificate
+	// signed by one of these CAs. With ClientAuth "verify-if-given",
+	// clients without a certificate are let through too.
+	ClientCAFile string `yaml:"clientCAFile"`
+	ClientAuth   string `yaml:"clientAuth"`
+}
+
+// AuditConfig represents the audit log configuration
+type AuditConfig struct {
+	Type string `yaml:"type"` // Registered audit sink name, defaults to "file"
+	Path string `yaml:"path"` // File events are appended to, stdout if empty or "-"
+}
+
+// RateLimitConfig represents per-client limits. Clients are told apart by
+// identity if they authenticate, by IP address otherwise. Zero disables a limit.
+type RateLimitConfig struct {
+	Requests float64 `yaml:"requests"` // Requests per second per client
+	Burst    int     `yaml:"burst"`    // Requests a client may make at once, defaults to twice Requests
+
+	// AddrRequests and AddrBurst limit requests per client address, before
+	// authentication, so that failed attempts are limited too. They default
+	// to Requests and Burst.
+	AddrRequests float64 `yaml:"addrRequests"`
+	AddrBurst    int     `yaml:"addrBurst"`
+
+	// Builds and NamespaceBuilds limit the upstream downloads that uncached
+	// versions trigger, per client and per namespace, in each Window.
+	Builds          int           `yaml:"builds"`
+	NamespaceBuilds int           `yaml:"namespaceBuilds"`
+	Window          time.Duration `yaml:"window"` // Defaults to 1h
+}
+
+// OutboundConfig represents the limits on requests to upstream repositories
+type OutboundConfig struct {
+	// AllowPrivateNetworks lets chart URLs and redirects reach private,
+	// loopback and link-local addresses. A repository's own host is always
+	// allowed.
+	AllowPrivateNetworks bool `yaml:"allowPrivateNetworks"`
+
+	MaxRedirects    int   `yaml:"maxRedirects"`    // Defaults to 5, negative to follow none
+	MaxDownloadSize int64 `yaml:"maxDownloadSize"` // Bytes, for indexes and charts; defaults to 100MiB
+}
+
+// RetentionConfig represents the retention policy for cached chart versions.
+// A version is kept if any of the rules keeps it.
+type RetentionConfig struct {
+	KeepLast int           `yaml:"keepLast"` // Keep the newest N versions of each chart
+	MaxIdle  time.Duration `yaml:"maxIdle"`  // Keep versions pulled within this duration
+	Pin      []string      `yaml:"pin"`      // Never remove versions matching these globs ("1.2.*" or "chart:1.2.*")
+}
+
+// LockConfig represents how build leases are shared between replicas
+type LockConfig struct {
+	Type string        `yaml:"type"` // "storage" (default) to keep leases in the bucket, or "redis"
+	TTL  time.Duration `yaml:"ttl"`  // How long a lease lasts without renewal, defaults to 5m
+
+	// Redis server, for the "redis" type
+	Address  string `yaml:"address"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+}
+
+// AuthConfig represents how clients authenticate
+type AuthConfig struct {
+	Realm    string        `yaml:"realm"`    // Realm of the Basic challenge, defaults to "helm-oci-proxy"
+	Htpasswd string        `yaml:"htpasswd"` // htpasswd file with bcrypt hashes, reloaded when it changes
+	Tokens   []StaticToken `yaml:"tokens"`   // Static tokens, presented as the password with any user name
+
+	// OIDC accepts JWTs from these issuers, e.g. CI workload identity
+	// tokens, as bearer tokens or as the password.
+	OIDC []OIDCConfig `yaml:"oidc"`
+
+	// Token switches clients to the token auth flow: they get short-lived
+	// tokens from the /token endpoint with the credentials above.
+	Token *TokenConfig `yaml:"token"`
+}
+
+// StaticToken represents a fixed client token
+type StaticToken struct {
+	Subject string `yaml:"subject"`
+	Token   string `yaml:"token"`
+}
+
+// OIDCConfig represents an issuer of JWTs that clients may authenticate with
+type OIDCConfig struct {
+	Issuer    string   `yaml:"issuer"`
+	Audiences []string `yaml:"audiences"` // Tokens must be issued for one of these
+	JWKSURL   string   `yaml:"jwksURL"`   // Defaults to the jwks_uri of the issuer's discovery document
+	JWKSFile  string   `yaml:"jwksFile"`  // Local key set, instead of fetching it
+
+	// SubjectClaim names the claim identifying the client, defaults to "sub"
+	SubjectClaim string `yaml:"subjectClaim"`
+	// GroupsClaim names the claim listing the client's groups, defaults to "groups"
+	GroupsClaim string `yaml:"groupsClaim"`
+
+	// Rules give namespaces to tokens by their claims. A token matching
+	// no rule can't pull anything.
+	Rules []ClaimRule `yaml:"rules"`
+}
+
+// ClaimRule grants namespaces to tokens whose claims all match. In claim
+// globs "*" matches any characters, "/" included, so that "repo:org/*"
+// matches the subject "repo:org/app:ref:refs/heads/main".
+type ClaimRule struct {
+	Claims     map[string]string `yaml:"claims"`     // Claim name to glob, matching any element of list claims
+	Namespaces []string          `yaml:"namespaces"` // Namespace globs, e.g. "argo" or "team-a-*"
+}
+
+// ACLConfig represents who may pull from which namespaces
+type ACLConfig struct {
+	Groups map[string][]string `yaml:"groups"` // Group name to member subject globs, in which "*" matches "/" too
+	Rules  []ACLRule           `yaml:"rules"`
+}
+
+// ACLRule allows the clients matching any of its subjects or groups to
+// perform its actions in its namespaces
+type ACLRule struct {
+	Subjects   []string `yaml:"subjects"`   // Subject globs, in which "*" matches "/" too; "*" matches every client, anonymous ones included
+	Groups     []string `yaml:"groups"`     // Groups from the ACL or the client's token
+	Namespaces []string `yaml:"namespaces"` // Namespace globs, e.g. "argo" or "internal-a/*"
+	Actions    []string `yaml:"actions"`    // Defaults to "pull", the only action
+}
+
+// TokenConfig represents the built-in token endpoint
+type TokenConfig struct {
+	Service string        `yaml:"service"` // Defaults to "helm-oci-proxy"
+	Issuer  string        `yaml:"issuer"`  // Defaults to "helm-oci-proxy"
+	Realm   string        `yaml:"realm"`   // URL of the token endpoint clients are sent to, required
+	Key     string        `yaml:"key"`     // PEM private key signing the tokens; generated at startup if empty
+	TTL     time.Duration `yaml:"ttl"`     // How long tokens are valid, defaults to 5m
 }
 
 // StorageConfig represents storage configuration
 type StorageConfig struct {
-	Type     string `yaml:"type"`     // "s3" or "gcs"
+	Type     string `yaml:"type"`     // Registered storage backend name, e.g. "s3" or "gcs"
 	Endpoint string `yaml:"endpoint"` // Custom endpoint URL
 	Bucket   string `yaml:"bucket"`   // Bucket name
 	Region   string `yaml:"region"`   // Region (for S3)
+	Prefix   string `yaml:"prefix"`   // Key prefix, so that deployments can share a bucket
+	Layout   string `yaml:"layout"`   // "flat" (default) or "namespaced"
+
+	// VerifyDigests hashes blobs while they are streamed to clients and
+	// quarantines those that don't match their digest
+	VerifyDigests bool `yaml:"verifyDigests"`
+
+	// Cache enables a local hot cache in front of the backend
+	Cache *CacheConfig `yaml:"cache"`
+
+	// node keeps the whole storage section so that backends can decode
+	// their own options from it.
+	node yaml.Node
+}
+
+// UnmarshalYAML decodes the common storage fields and remembers the raw node
+// for backend-specific options.
+func (c *StorageConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain StorageConfig
+	if err := value.Decode((*plain)(c)); err != nil {
+		return err
+	}
+	c.node = *value
+	return nil
+}
+
+// Decode decodes the backend-specific options of the storage section into v.
+// It is a no-op when the config was not loaded from YAML.
+func (c StorageConfig) Decode(v any) error {
+	if c.node.Kind == 0 {
+		return nil
+	}
+	return c.node.Decode(v)
+}
+
+// CacheConfig represents the local hot cache configuration. Sizes are in bytes.
+type CacheConfig struct {
+	MemorySize    int64  `yaml:"memorySize"`    // Max bytes kept in memory
+	MaxObjectSize int64  `yaml:"maxObjectSize"` // Larger objects bypass the cache, defaults to 1MiB
+	Dir           string `yaml:"dir"`           // Directory for the optional on-disk tier
+	DiskSize      int64  `yaml:"diskSize"`      // Max bytes kept on disk
+
+	TagTTL time.Duration `yaml:"tagTTL"` // How long tag pointers are kept in memory, defaults to 30s
 }